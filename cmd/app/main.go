@@ -1,22 +1,41 @@
 package main
 
 import (
-	_jwt "github.com/golang-jwt/jwt/v5"
+	"context"
+	"fmt"
 	"github.com/ilyakaznacheev/cleanenv"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
 	"restAuthPart/internal/db"
 	"restAuthPart/internal/emailService"
+	"restAuthPart/internal/ippolicy"
+	"restAuthPart/internal/janitor"
 	"restAuthPart/internal/jwt"
 	"restAuthPart/internal/logger/sl"
+	"restAuthPart/internal/metrics"
 	"restAuthPart/internal/router"
 	"restAuthPart/internal/service"
+	"restAuthPart/internal/tracing"
+	"strconv"
+	"syscall"
+	"time"
 )
 
+const configPath = "./config.yml"
+
+// flushTimeout limits export of buffered spans on exit
+const flushTimeout = 5 * time.Second
+
 // Config ...
 type Config struct {
-	JWTConfig      jwt.Config    `yaml:"jwt" env-prefix:"JWT_"`
-	RouterConfig   router.Config `yaml:"router" env-prefix:"ROUTER_"`
-	DatabaseConfig db.Config     `yaml:"db" env-prefix:"DB_"`
+	JWTConfig      jwt.Config      `yaml:"jwt" env-prefix:"JWT_"`
+	RouterConfig   router.Config   `yaml:"router" env-prefix:"ROUTER_"`
+	DatabaseConfig db.Config       `yaml:"db" env-prefix:"DB_"`
+	JanitorConfig  janitor.Config  `yaml:"janitor" env-prefix:"JANITOR_"`
+	TracingConfig  tracing.Config  `yaml:"tracing" env-prefix:"TRACING_"`
+	IPPolicyConfig ippolicy.Config `yaml:"ipPolicy" env-prefix:"IP_POLICY_"`
 }
 
 // readConfig ...
@@ -31,25 +50,234 @@ func readConfig(filename string) (*Config, error) {
 func main() {
 	sl.SetupLogger("local")
 
-	cfg, err := readConfig("./config.yml")
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(&cfg.DatabaseConfig, os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	database, err := openDatabase(&cfg.DatabaseConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	jwtManager, err := jwt.New(&cfg.JWTConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	appMetrics := metrics.New()
+	if pool, ok := database.(interface{ PoolStats() db.PoolStats }); ok {
+		appMetrics.RegisterPool(func() (int, int, int, int) {
+			stats := pool.PoolStats()
+			return stats.Max, stats.Total, stats.Idle, stats.InUse
+		})
+	}
+
+	tracer, err := tracing.New(context.Background(), &cfg.TracingConfig)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if tracer.Enabled() {
+		database = tracing.NewDatabase(database, cfg.DatabaseConfig.Driver)
+	}
+	database = metrics.NewDatabase(database, appMetrics)
+	appMetrics.RegisterSessions(func(ctx context.Context) (int, error) {
+		// Sessions without refresh token issued within its lifetime are expired
+		return database.CountActiveSessions(ctx, time.Now().Add(-jwtManager.RefreshTTL()))
+	})
 
-	database, err := db.New(&cfg.DatabaseConfig)
+	rehashed, err := database.RehashLegacyTokens(context.Background(), jwtManager.HashToken)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if rehashed > 0 {
+		slog.Info("Plaintext refresh tokens rehashed", slog.Int("count", rehashed))
+	}
 
-	jwtManager := jwt.New(&cfg.JWTConfig, _jwt.SigningMethodHS512)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Background jobs are stopped after in-flight requests are drained
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	cleaner, err := janitor.New(&cfg.JanitorConfig, database, jwtManager)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cleanerDone := make(chan struct{})
+	go func() {
+		cleaner.Run(jobsCtx)
+		close(cleanerDone)
+	}()
 
 	email := emailService.New()
 
-	svc := service.New(jwtManager, database, email)
+	ipPolicy, err := ippolicy.New(&cfg.IPPolicyConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	svc := service.New(jwtManager, database, email, appMetrics, ipPolicy)
 
-	r := router.New(&cfg.RouterConfig, svc)
-	err = r.Run()
+	r, err := router.New(&cfg.RouterConfig, svc, appMetrics, tracer)
 	if err != nil {
 		log.Fatalln(err)
 	}
+
+	go reloadOnSignal(configPath, jwtManager, r)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- r.Run()
+	}()
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	case runErr = <-serverErr:
+	}
+	// Second signal kills the process
+	stop()
+
+	if runErr == nil {
+		svc.SetDraining()
+		time.Sleep(cfg.RouterConfig.ShutdownDelay)
+	}
+	if shutdownErr := r.Shutdown(context.Background()); shutdownErr != nil {
+		slog.Error("Cannot drain requests", slog.String("err", shutdownErr.Error()))
+	}
+	stopJobs()
+	<-cleanerDone
+	database.Close()
+	ipPolicy.Close()
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), flushTimeout)
+	if err := tracer.Shutdown(flushCtx); err != nil {
+		slog.Error("Cannot flush spans", slog.String("err", err.Error()))
+	}
+	cancelFlush()
+
+	if runErr != nil {
+		log.Fatalln(runErr)
+	}
+	slog.Info("Server stopped")
+}
+
+// storage is a database the server can run with
+type storage interface {
+	service.IDatabase
+	janitor.IDatabase
+	RehashLegacyTokens(ctx context.Context, hash func(token string) []byte) (int, error)
+	CountActiveSessions(ctx context.Context, createdAfter time.Time) (int, error)
+	Close()
+}
+
+// sqlStorage is a storage with versioned migrations
+type sqlStorage interface {
+	storage
+	MigrateUp(ctx context.Context) error
+	MigrateDown(ctx context.Context, n int) error
+}
+
+// openDatabase opens storage selected by cfg.Driver.
+// Pending migrations are applied if cfg.MigrateOnStart is set
+func openDatabase(cfg *db.Config) (storage, error) {
+	if cfg.Driver == "memory" {
+		slog.Warn("Using in-memory storage, data will be lost on restart")
+		return db.NewMemory(), nil
+	}
+
+	database, err := openSQLDatabase(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MigrateOnStart {
+		if err := database.MigrateUp(context.Background()); err != nil {
+			database.Close()
+			return nil, err
+		}
+	}
+	return database, nil
+}
+
+// openSQLDatabase opens Postgres or SQLite storage selected by cfg.Driver
+func openSQLDatabase(cfg *db.Config) (sqlStorage, error) {
+	switch cfg.Driver {
+	case "postgres":
+		database, err := db.New(context.Background(), cfg)
+		if err != nil {
+			return nil, err
+		}
+		return database, nil
+	case "sqlite":
+		database, err := db.NewSQLite(context.Background(), cfg)
+		if err != nil {
+			return nil, err
+		}
+		return database, nil
+	case "memory":
+		return nil, fmt.Errorf("db driver %q doesn't support migrations", cfg.Driver)
+	default:
+		return nil, fmt.Errorf("unknown db driver: %q", cfg.Driver)
+	}
+}
+
+// migrate runs `migrate up` or `migrate down [n]` subcommand
+func migrate(cfg *db.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up | migrate down [n]")
+	}
+
+	database, err := openSQLDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	switch args[0] {
+	case "up":
+		return database.MigrateUp(context.Background())
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				return fmt.Errorf("bad number of migrations: %q", args[1])
+			}
+		}
+		return database.MigrateDown(context.Background(), n)
+	default:
+		return fmt.Errorf("unknown migrate command: %q", args[0])
+	}
+}
+
+// reloadOnSignal rereads config on SIGHUP and replaces signing keys and
+// TLS certificates so they can be rotated without restart
+func reloadOnSignal(filename string, manager *jwt.Manager, r *router.Router) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		cfg, err := readConfig(filename)
+		if err != nil {
+			slog.Error("Cannot reload config", slog.String("err", err.Error()))
+			continue
+		}
+		if err := manager.Reload(&cfg.JWTConfig); err != nil {
+			slog.Error("Cannot reload signing keys", slog.String("err", err.Error()))
+		} else {
+			slog.Info("Signing keys reloaded")
+		}
+
+		if err := r.ReloadTLS(); err != nil {
+			slog.Error("Cannot reload TLS certificates", slog.String("err", err.Error()))
+		}
+	}
 }
@@ -2,85 +2,419 @@ package db
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
-	_ "golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"restAuthPart/internal/models"
+	"time"
 )
 
 // Config ...
 type Config struct {
+	// Driver is the storage: postgres, sqlite or memory. Memory storage loses data on restart
+	Driver   string `yaml:"driver" env:"DRIVER" env-default:"postgres"`
 	Host     string `yaml:"host" env:"HOST" env-default:"localhost"`
 	Port     string `yaml:"port" env:"PORT" env-default:"5432"`
 	User     string `yaml:"user" env:"USER" env-default:"postgres"`
 	Password string `yaml:"password" env:"PASSWORD" env-default:"postgres"`
 	DbName   string `yaml:"dbName" env:"DB_NAME" env-default:"testtask"`
+	// Path is the database file of sqlite driver
+	Path string `yaml:"path" env:"PATH" env-default:"auth.db"`
+	// Connection pool settings
+	MaxConns          int32         `yaml:"maxConns" env:"MAX_CONNS" env-default:"10"`
+	MinConns          int32         `yaml:"minConns" env:"MIN_CONNS" env-default:"1"`
+	MaxConnLifetime   time.Duration `yaml:"maxConnLifetime" env:"MAX_CONN_LIFETIME" env-default:"1h"`
+	MaxConnIdleTime   time.Duration `yaml:"maxConnIdleTime" env:"MAX_CONN_IDLE_TIME" env-default:"30m"`
+	HealthCheckPeriod time.Duration `yaml:"healthCheckPeriod" env:"HEALTH_CHECK_PERIOD" env-default:"1m"`
+	// MigrateOnStart applies pending migrations when the server starts
+	MigrateOnStart bool `yaml:"migrateOnStart" env:"MIGRATE_ON_START" env-default:"true"`
 }
 
 // DB ...
 type DB struct {
 	cfg *Config
-	db  *pgx.Conn
+	db  *pgxpool.Pool
 }
 
 // New ...
-func New(cfg *Config) (*DB, error) {
+func New(ctx context.Context, cfg *Config) (*DB, error) {
 	d := &DB{
 		cfg: cfg,
 	}
 
-	db, err := pgx.Connect(context.Background(), fmt.Sprintf("postgres://%s:%s@%s:%s/%s",
+	poolConfig, err := pgxpool.ParseConfig(fmt.Sprintf("postgres://%s:%s@%s:%s/%s",
 		cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.DbName))
 	if err != nil {
 		return nil, err
 	}
+	poolConfig.MaxConns = cfg.MaxConns
+	poolConfig.MinConns = cfg.MinConns
+	poolConfig.MaxConnLifetime = cfg.MaxConnLifetime
+	poolConfig.MaxConnIdleTime = cfg.MaxConnIdleTime
+	poolConfig.HealthCheckPeriod = cfg.HealthCheckPeriod
+
+	db, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
 	d.db = db
 
 	return d, nil
 }
 
+// notFound replaces pgx.ErrNoRows with models.ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.ErrNotFound
+	}
+	return err
+}
+
+// constraintError replaces unique and foreign key violations
+// with models.ErrDuplicate and models.ErrNotFound
+func constraintError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch pgErr.Code {
+	case "23505":
+		return fmt.Errorf("%s: %w", pgErr.ConstraintName, models.ErrDuplicate)
+	case "23503":
+		return fmt.Errorf("%s: %w", pgErr.ConstraintName, models.ErrNotFound)
+	}
+	return err
+}
+
+// Ping checks that database is reachable
+func (d *DB) Ping(ctx context.Context) error {
+	return d.db.Ping(ctx)
+}
+
+// PoolStats is usage of connection pool
+type PoolStats struct {
+	Max   int
+	Total int
+	Idle  int
+	InUse int
+}
+
+// PoolStats returns usage of connection pool
+func (d *DB) PoolStats() PoolStats {
+	stat := d.db.Stat()
+	return PoolStats{
+		Max:   int(stat.MaxConns()),
+		Total: int(stat.TotalConns()),
+		Idle:  int(stat.IdleConns()),
+		InUse: int(stat.AcquiredConns()),
+	}
+}
+
 // Close ...
-func (d *DB) Close() error {
-	return d.db.Close(context.Background())
+func (d *DB) Close() {
+	d.db.Close()
 }
 
-// AddUserIfNotExist insert models.User to table users and update its ip if it exists
-func (d *DB) AddUserIfNotExist(user models.User) error {
-	_, err := d.db.Exec(context.Background(),
-		`INSERT INTO public.users (id, ip) 
-			 VALUES ($1, $2, $3)
-			 ON CONFLICT (id) DO UPDATE SET ip=$2`, user.Guid, user.Ip, user.Email,
+// AddUserIfNotExist insert models.User to table users and update its ip if it exists.
+// Stored email is kept if user.Email is empty
+func (d *DB) AddUserIfNotExist(ctx context.Context, user models.User) error {
+	_, err := d.db.Exec(ctx,
+		`INSERT INTO public.users (id, ip, mail)
+			 VALUES ($1, $2, NULLIF($3, ''))
+			 ON CONFLICT (id) DO UPDATE SET ip=$2, mail=COALESCE(NULLIF($3, ''), users.mail)`,
+		user.Guid, user.Ip, user.Email,
 	)
 	return err
 }
 
-// AddRefreshToken insert token for user to table tokens
-func (d *DB) AddRefreshToken(token string, guid uuid.UUID) (int, error) {
+// AddTokenFamily creates a new family for refresh tokens of one login
+func (d *DB) AddTokenFamily(ctx context.Context, guid uuid.UUID) (uuid.UUID, error) {
+	familyId := uuid.New()
+	_, err := d.db.Exec(ctx,
+		`INSERT INTO public.token_families (id, user_id) VALUES ($1, $2)`, familyId, guid)
+	return familyId, constraintError(err)
+}
+
+// AddRefreshToken insert token to table tokens. token.Token must be hash of the token
+func (d *DB) AddRefreshToken(ctx context.Context, token models.RefreshToken) (int, error) {
 	var id int
 
-	//bytes, err := bcrypt.GenerateFromPassword([]byte(token), 8) // Use cost 8 because it is not stated in task
-	//if err != nil {
-	//	return 0, err
-	//}
-	err := d.db.QueryRow(context.Background(),
-		`INSERT INTO public.tokens (user_id, token)
-			 VALUES ($1, $2) RETURNING id`, guid, []byte(token)).Scan(&id)
-	return id, err
+	err := d.db.QueryRow(ctx,
+		`INSERT INTO public.tokens (user_id, token, family_id, created_ip, user_agent)
+			 VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		token.UserId, token.Token, token.FamilyId, token.CreatedIp, token.UserAgent).Scan(&id)
+	return id, constraintError(err)
+}
+
+// RehashLegacyTokens replaces plaintext tokens stored before hashing was introduced with their hashes.
+// Plaintext rows are told apart by length: hashes are always sha256.Size bytes long
+func (d *DB) RehashLegacyTokens(ctx context.Context, hash func(token string) []byte) (int, error) {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`SELECT id, token FROM public.tokens WHERE length(token) <> $1 FOR UPDATE`, sha256.Size)
+	if err != nil {
+		return 0, err
+	}
+	legacy := make(map[int][]byte)
+	for rows.Next() {
+		var id int
+		var token []byte
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		legacy[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, token := range legacy {
+		if _, err := tx.Exec(ctx, `UPDATE public.tokens SET token=$1 WHERE id=$2`, hash(string(token)), id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(legacy), tx.Commit(ctx)
+}
+
+// refreshTokenSelect selects models.RefreshToken fields, see scanRefreshToken.
+// Token is revoked if either it or its family is revoked
+const refreshTokenSelect = `SELECT t.id, t.user_id, t.family_id, f.created_at, t.token, t.created_at, t.used_at,
+			        COALESCE(t.revoked_at, f.revoked_at), t.last_used_at, t.created_ip, COALESCE(t.last_ip, ''), t.user_agent
+			 FROM public.tokens t JOIN public.token_families f ON f.id = t.family_id`
+
+// scanRefreshToken scans row selected with refreshTokenSelect
+func scanRefreshToken(row pgx.Row) (models.RefreshToken, error) {
+	var token models.RefreshToken
+	err := row.Scan(&token.Id, &token.UserId, &token.FamilyId, &token.SessionCreatedAt, &token.Token, &token.CreatedAt, &token.UsedAt,
+		&token.RevokedAt, &token.LastUsedAt, &token.CreatedIp, &token.LastIp, &token.UserAgent)
+	return token, notFound(err)
+}
+
+// GetRefreshToken returns token from table tokens by id
+func (d *DB) GetRefreshToken(ctx context.Context, refreshTokenId int) (models.RefreshToken, error) {
+	return scanRefreshToken(d.db.QueryRow(ctx,
+		refreshTokenSelect+` WHERE t.id=$1`, refreshTokenId))
+}
+
+// GetRefreshTokenByHash returns token from table tokens by hash of the token
+func (d *DB) GetRefreshTokenByHash(ctx context.Context, tokenHash []byte) (models.RefreshToken, error) {
+	return scanRefreshToken(d.db.QueryRow(ctx,
+		refreshTokenSelect+` WHERE t.token=$1`, tokenHash))
+}
+
+// MarkRefreshTokenUsed sets used_at, last_used_at and last_ip of token.
+// Returns false if the token was already used
+func (d *DB) MarkRefreshTokenUsed(ctx context.Context, refreshTokenId int, ip string) (bool, error) {
+	tag, err := d.db.Exec(ctx,
+		`UPDATE public.tokens SET used_at=now(), last_used_at=now(), last_ip=$2
+			 WHERE id=$1 AND used_at IS NULL`, refreshTokenId, ip)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// RevokeTokenFamily revokes all refresh tokens of the family
+func (d *DB) RevokeTokenFamily(ctx context.Context, familyId uuid.UUID) error {
+	_, err := d.db.Exec(ctx,
+		`UPDATE public.token_families SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL`, familyId)
+	return err
+}
+
+// RevokeRefreshToken sets revoked_at of token
+func (d *DB) RevokeRefreshToken(ctx context.Context, refreshTokenId int) error {
+	_, err := d.db.Exec(ctx,
+		`UPDATE public.tokens SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL`, refreshTokenId)
+	return err
 }
 
-// GetRefreshToken returns hashed token from table tokens
-func (d *DB) GetRefreshToken(refreshTokenId int) ([]byte, error) {
-	var hashedToken []byte
+// DenyAccessToken adds access token id to table denied_tokens until the token expires
+func (d *DB) DenyAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := d.db.Exec(ctx,
+		`INSERT INTO public.denied_tokens (jti, expires_at) VALUES ($1, $2)
+			 ON CONFLICT (jti) DO NOTHING`, jti, expiresAt)
+	return err
+}
+
+// AddIPChangeEvent inserts decision of ip change policy to table ip_change_audit
+func (d *DB) AddIPChangeEvent(ctx context.Context, event models.IPChangeEvent) error {
+	_, err := d.db.Exec(ctx,
+		`INSERT INTO public.ip_change_audit
+			 (user_id, family_id, old_ip, new_ip, old_asn, new_asn, old_country, new_country, action, rule)
+			 VALUES ($1, $2, $3, $4, NULLIF($5::bigint, 0), NULLIF($6::bigint, 0),
+			         NULLIF($7::text, ''), NULLIF($8::text, ''), $9, $10)`,
+		event.UserId, event.FamilyId, event.OldIp, event.NewIp, int64(event.OldASN), int64(event.NewASN),
+		event.OldCountry, event.NewCountry, event.Action, event.Rule)
+	return constraintError(err)
+}
+
+// GetIPChangeEvents returns audit trail of ip changes of user, oldest first
+func (d *DB) GetIPChangeEvents(ctx context.Context, guid uuid.UUID) ([]models.IPChangeEvent, error) {
+	rows, err := d.db.Query(ctx,
+		`SELECT id, user_id, family_id, old_ip, new_ip, COALESCE(old_asn, 0), COALESCE(new_asn, 0),
+			        COALESCE(old_country, ''), COALESCE(new_country, ''), action, rule, created_at
+			 FROM public.ip_change_audit WHERE user_id=$1 ORDER BY id`, guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]models.IPChangeEvent, 0)
+	for rows.Next() {
+		var event models.IPChangeEvent
+		var oldASN, newASN int64
+		if err := rows.Scan(&event.Id, &event.UserId, &event.FamilyId, &event.OldIp, &event.NewIp, &oldASN, &newASN,
+			&event.OldCountry, &event.NewCountry, &event.Action, &event.Rule, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.OldASN, event.NewASN = uint(oldASN), uint(newASN)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// IsAccessTokenDenied reports whether access token id is in table denied_tokens
+func (d *DB) IsAccessTokenDenied(ctx context.Context, jti string) (bool, error) {
+	var denied bool
+	err := d.db.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM public.denied_tokens WHERE jti=$1)`, jti).Scan(&denied)
+	return denied, err
+}
+
+// GetSessions returns not revoked token families of user with their unused token created after createdAfter
+func (d *DB) GetSessions(ctx context.Context, guid uuid.UUID, createdAfter time.Time) ([]models.Session, error) {
+	rows, err := d.db.Query(ctx,
+		`SELECT f.id, f.created_at,
+			        (SELECT max(t.last_used_at) FROM public.tokens t WHERE t.family_id = f.id),
+			        (SELECT t.created_ip FROM public.tokens t WHERE t.family_id = f.id ORDER BY t.id LIMIT 1),
+			        head.created_ip, head.user_agent, head.id
+			 FROM public.token_families f
+			 JOIN public.tokens head ON head.family_id = f.id AND head.used_at IS NULL AND head.revoked_at IS NULL
+			 WHERE f.user_id=$1 AND f.revoked_at IS NULL AND head.created_at > $2
+			 ORDER BY f.created_at DESC`, guid, createdAfter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]models.Session, 0)
+	for rows.Next() {
+		var session models.Session
+		if err := rows.Scan(&session.Id, &session.CreatedAt, &session.LastUsedAt, &session.CreatedIp,
+			&session.LastIp, &session.UserAgent, &session.RefreshId); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// CountActiveSessions counts not revoked token families having unused token created after createdAfter
+func (d *DB) CountActiveSessions(ctx context.Context, createdAfter time.Time) (int, error) {
+	var count int
+	err := d.db.QueryRow(ctx,
+		`SELECT count(DISTINCT f.id)
+			 FROM public.token_families f
+			 JOIN public.tokens head ON head.family_id = f.id AND head.used_at IS NULL AND head.revoked_at IS NULL
+			 WHERE f.revoked_at IS NULL AND head.created_at > $1`, createdAfter).Scan(&count)
+	return count, err
+}
 
-	err := d.db.QueryRow(context.Background(),
-		`SELECT token FROM public.tokens WHERE id=$1`, refreshTokenId).Scan(&hashedToken)
-	return hashedToken, err
+// RevokeSession revokes token family of user. Returns false if there is no such active family
+func (d *DB) RevokeSession(ctx context.Context, guid uuid.UUID, sessionId uuid.UUID) (bool, error) {
+	tag, err := d.db.Exec(ctx,
+		`UPDATE public.token_families SET revoked_at=now()
+			 WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL`, sessionId, guid)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
 }
 
-func (d *DB) GetUser(guid uuid.UUID) (models.User, error) {
+// GetUser returns user from table users
+func (d *DB) GetUser(ctx context.Context, guid uuid.UUID) (models.User, error) {
 	var user models.User
-	err := d.db.QueryRow(context.Background(),
-		`SELECT * FROM public.users WHERE id=$1`, guid).Scan(&user.Guid, &user.Ip, &user.Email)
-	return user, err
+	err := d.db.QueryRow(ctx,
+		`SELECT id, ip, COALESCE(mail, ''), revoked_before FROM public.users WHERE id=$1`, guid).Scan(
+		&user.Guid, &user.Ip, &user.Email, &user.RevokedBefore)
+	return user, notFound(err)
+}
+
+// RevokeUserTokens revokes all token families of user and sets its revoked_before
+func (d *DB) RevokeUserTokens(ctx context.Context, guid uuid.UUID, revokedBefore time.Time) error {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `UPDATE public.users SET revoked_before=$2 WHERE id=$1`, guid, revokedBefore)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrNotFound
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE public.token_families SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL`, guid); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// DeleteStaleTokens deletes at most limit tokens created before expiredBefore
+// or revoked with their family before revokedBefore
+func (d *DB) DeleteStaleTokens(ctx context.Context, expiredBefore, revokedBefore time.Time, limit int) (int, error) {
+	tag, err := d.db.Exec(ctx,
+		`DELETE FROM public.tokens WHERE id IN (
+			 SELECT t.id FROM public.tokens t JOIN public.token_families f ON f.id = t.family_id
+			 WHERE t.created_at < $1 OR COALESCE(t.revoked_at, f.revoked_at) < $2
+			 LIMIT $3)`, expiredBefore, revokedBefore, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// DeleteStaleFamilies deletes at most limit token families created before createdBefore
+// which have no tokens left
+func (d *DB) DeleteStaleFamilies(ctx context.Context, createdBefore time.Time, limit int) (int, error) {
+	tag, err := d.db.Exec(ctx,
+		`DELETE FROM public.token_families WHERE id IN (
+			 SELECT f.id FROM public.token_families f
+			 WHERE f.created_at < $1 AND NOT EXISTS (SELECT 1 FROM public.tokens t WHERE t.family_id = f.id)
+			 LIMIT $2)`, createdBefore, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// DeleteExpiredDeniedTokens deletes at most limit rows of denied_tokens expired before expiredBefore
+func (d *DB) DeleteExpiredDeniedTokens(ctx context.Context, expiredBefore time.Time, limit int) (int, error) {
+	tag, err := d.db.Exec(ctx,
+		`DELETE FROM public.denied_tokens WHERE jti IN (
+			 SELECT jti FROM public.denied_tokens WHERE expires_at < $1 LIMIT $2)`, expiredBefore, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
 }
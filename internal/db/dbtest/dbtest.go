@@ -0,0 +1,459 @@
+// Package dbtest is a conformance suite for service.IDatabase implementations
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"restAuthPart/internal/models"
+	"restAuthPart/internal/service"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rehasher is implemented by storages which may keep plaintext tokens of older versions
+type rehasher interface {
+	RehashLegacyTokens(ctx context.Context, hash func(token string) []byte) (int, error)
+}
+
+// cleaner is implemented by storages cleaned up by janitor
+type cleaner interface {
+	DeleteStaleTokens(ctx context.Context, expiredBefore, revokedBefore time.Time, limit int) (int, error)
+	DeleteStaleFamilies(ctx context.Context, createdBefore time.Time, limit int) (int, error)
+	DeleteExpiredDeniedTokens(ctx context.Context, expiredBefore time.Time, limit int) (int, error)
+}
+
+// sessionCounter is implemented by storages reporting active sessions to metrics
+type sessionCounter interface {
+	CountActiveSessions(ctx context.Context, createdAfter time.Time) (int, error)
+}
+
+// auditor is implemented by storages keeping audit trail of ip changes
+type auditor interface {
+	GetIPChangeEvents(ctx context.Context, guid uuid.UUID) ([]models.IPChangeEvent, error)
+}
+
+// Run runs the suite against storage. newStorage is called for every test
+// and must return storage with empty database
+func Run(t *testing.T, newStorage func(t *testing.T) service.IDatabase) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s service.IDatabase)
+	}{
+		{"Users", testUsers},
+		{"RefreshTokens", testRefreshTokens},
+		{"ConcurrentTokens", testConcurrentTokens},
+		{"Revocation", testRevocation},
+		{"Cleanup", testCleanup},
+		{"ActiveSessions", testActiveSessions},
+		{"IPChangeAudit", testIPChangeAudit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func testUsers(t *testing.T, s service.IDatabase) {
+	ctx := context.Background()
+	guid := uuid.New()
+
+	if _, err := s.GetUser(ctx, guid); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetUser of unknown user returned wrong error: got %v want %v", err, models.ErrNotFound)
+	}
+
+	// Upsert keeps email when it isn't passed
+	if err := s.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: "1.1.1.1", Email: "user@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: "2.2.2.2"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.GetUser(ctx, guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Ip != "2.2.2.2" || user.Email != "user@example.com" {
+		t.Errorf("GetUser returned wrong user: got %+v", user)
+	}
+
+	if err := s.RevokeUserTokens(ctx, uuid.New(), time.Now()); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("RevokeUserTokens of unknown user returned wrong error: got %v want %v", err, models.ErrNotFound)
+	}
+}
+
+func testRefreshTokens(t *testing.T, s service.IDatabase) {
+	ctx := context.Background()
+	guid := uuid.New()
+
+	if _, err := s.AddTokenFamily(ctx, guid); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("AddTokenFamily of unknown user returned wrong error: got %v want %v", err, models.ErrNotFound)
+	}
+
+	if err := s.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	familyId, err := s.AddTokenFamily(ctx, guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s.AddRefreshToken(ctx, models.RefreshToken{UserId: guid, FamilyId: familyId, Token: []byte("first")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.AddRefreshToken(ctx, models.RefreshToken{UserId: guid, FamilyId: familyId, Token: []byte("second")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second <= first {
+		t.Errorf("AddRefreshToken returned wrong ids: got %v after %v", second, first)
+	}
+
+	if _, err := s.AddRefreshToken(ctx, models.RefreshToken{UserId: guid, FamilyId: familyId, Token: []byte("first")}); !errors.Is(err, models.ErrDuplicate) {
+		t.Errorf("AddRefreshToken of duplicate token returned wrong error: got %v want %v", err, models.ErrDuplicate)
+	}
+
+	used, err := s.MarkRefreshTokenUsed(ctx, first, "2.2.2.2")
+	if err != nil || !used {
+		t.Errorf("MarkRefreshTokenUsed returned wrong result: got %v, %v want true, nil", used, err)
+	}
+	if used, _ := s.MarkRefreshTokenUsed(ctx, first, "2.2.2.2"); used {
+		t.Errorf("MarkRefreshTokenUsed marked used token again")
+	}
+
+	if err := s.RevokeTokenFamily(ctx, familyId); err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.GetRefreshTokenByHash(ctx, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Id != second || token.RevokedAt == nil {
+		t.Errorf("GetRefreshTokenByHash returned wrong token: got %+v", token)
+	}
+
+	if _, err := s.GetRefreshToken(ctx, -1); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetRefreshToken of unknown token returned wrong error: got %v want %v", err, models.ErrNotFound)
+	}
+}
+
+func testConcurrentTokens(t *testing.T, s service.IDatabase) {
+	ctx := context.Background()
+	guid := uuid.New()
+	if err := s.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	familyId, err := s.AddTokenFamily(ctx, guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ids := make(chan int, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := s.AddRefreshToken(ctx, models.RefreshToken{UserId: guid, FamilyId: familyId, Token: []byte(fmt.Sprint(i))})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- id
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("AddRefreshToken returned id %v twice", id)
+		}
+		seen[id] = true
+	}
+
+	sessions, err := s.GetSessions(ctx, guid, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 100 {
+		t.Fatalf("GetSessions returned wrong number of sessions: got %v want 100", len(sessions))
+	}
+
+	// Token is used once even if it is presented concurrently
+	var marked atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			used, err := s.MarkRefreshTokenUsed(ctx, sessions[0].RefreshId, "2.2.2.2")
+			if err != nil {
+				t.Error(err)
+			}
+			if used {
+				marked.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if marked.Load() != 1 {
+		t.Errorf("MarkRefreshTokenUsed marked token %v times want 1", marked.Load())
+	}
+}
+
+func testRevocation(t *testing.T, s service.IDatabase) {
+	ctx := context.Background()
+	guid := uuid.New()
+	if err := s.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	familyId, err := s.AddTokenFamily(ctx, guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.AddRefreshToken(ctx, models.RefreshToken{UserId: guid, FamilyId: familyId, Token: []byte("legacy"),
+		CreatedIp: "1.1.1.1", UserAgent: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Plaintext token is replaced with its hash
+	if r, ok := s.(rehasher); ok {
+		hash := func(token string) []byte { return make([]byte, 32) }
+		if rehashed, err := r.RehashLegacyTokens(ctx, hash); err != nil || rehashed != 1 {
+			t.Errorf("RehashLegacyTokens returned wrong result: got %v, %v want 1, nil", rehashed, err)
+		}
+		if _, err := s.GetRefreshTokenByHash(ctx, make([]byte, 32)); err != nil {
+			t.Errorf("GetRefreshTokenByHash of rehashed token returned error: %v", err)
+		}
+	}
+
+	sessions, err := s.GetSessions(ctx, guid, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Id != familyId || sessions[0].RefreshId != id || sessions[0].UserAgent != "test" {
+		t.Errorf("GetSessions returned wrong sessions: got %+v", sessions)
+	}
+	// Session whose unused token was created before createdAfter is expired
+	if sessions, _ := s.GetSessions(ctx, guid, time.Now().Add(time.Minute)); len(sessions) != 0 {
+		t.Errorf("GetSessions returned expired session: got %+v", sessions)
+	}
+
+	if revoked, err := s.RevokeSession(ctx, uuid.New(), familyId); err != nil || revoked {
+		t.Errorf("RevokeSession of other user returned wrong result: got %v, %v want false, nil", revoked, err)
+	}
+	if revoked, err := s.RevokeSession(ctx, guid, familyId); err != nil || !revoked {
+		t.Errorf("RevokeSession returned wrong result: got %v, %v want true, nil", revoked, err)
+	}
+	if sessions, _ := s.GetSessions(ctx, guid, time.Now().Add(-time.Hour)); len(sessions) != 0 {
+		t.Errorf("GetSessions returned revoked session: got %+v", sessions)
+	}
+
+	if err := s.DenyAccessToken(ctx, "jti", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DenyAccessToken(ctx, "jti", time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("DenyAccessToken of denied token returned error: %v", err)
+	}
+	if denied, err := s.IsAccessTokenDenied(ctx, "jti"); err != nil || !denied {
+		t.Errorf("IsAccessTokenDenied returned wrong result: got %v, %v want true, nil", denied, err)
+	}
+	if denied, err := s.IsAccessTokenDenied(ctx, "other"); err != nil || denied {
+		t.Errorf("IsAccessTokenDenied returned wrong result: got %v, %v want false, nil", denied, err)
+	}
+
+	revokedBefore := time.Now()
+	if err := s.RevokeUserTokens(ctx, guid, revokedBefore); err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.GetUser(ctx, guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Postgres keeps microseconds only
+	if user.RevokedBefore == nil || user.RevokedBefore.Sub(revokedBefore).Abs() > time.Millisecond {
+		t.Errorf("GetUser returned wrong revoked_before: got %v want %v", user.RevokedBefore, revokedBefore)
+	}
+}
+
+func testCleanup(t *testing.T, s service.IDatabase) {
+	c, ok := s.(cleaner)
+	if !ok {
+		t.Skip("storage isn't cleaned up")
+	}
+	ctx := context.Background()
+	guid := uuid.New()
+	if err := s.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two families with two tokens each, the first one is revoked
+	var families []uuid.UUID
+	var ids []int
+	for i := 0; i < 2; i++ {
+		familyId, err := s.AddTokenFamily(ctx, guid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		families = append(families, familyId)
+		for j := 0; j < 2; j++ {
+			id, err := s.AddRefreshToken(ctx, models.RefreshToken{UserId: guid, FamilyId: familyId, Token: []byte(fmt.Sprint(i, j))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+	}
+	if err := s.RevokeTokenFamily(ctx, families[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DenyAccessToken(ctx, "expired", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DenyAccessToken(ctx, "valid", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	// Nothing is stale yet
+	if deleted, err := c.DeleteStaleTokens(ctx, past, past, 10); err != nil || deleted != 0 {
+		t.Errorf("DeleteStaleTokens returned wrong result: got %v, %v want 0, nil", deleted, err)
+	}
+
+	// Tokens of revoked family are deleted in batches
+	if deleted, err := c.DeleteStaleTokens(ctx, past, future, 1); err != nil || deleted != 1 {
+		t.Errorf("DeleteStaleTokens returned wrong result: got %v, %v want 1, nil", deleted, err)
+	}
+	if deleted, err := c.DeleteStaleTokens(ctx, past, future, 10); err != nil || deleted != 1 {
+		t.Errorf("DeleteStaleTokens returned wrong result: got %v, %v want 1, nil", deleted, err)
+	}
+	if _, err := s.GetRefreshToken(ctx, ids[2]); err != nil {
+		t.Errorf("DeleteStaleTokens deleted active token: %v", err)
+	}
+
+	// Only the emptied family is deleted, families with tokens are kept
+	if deleted, err := c.DeleteStaleFamilies(ctx, future, 10); err != nil || deleted != 1 {
+		t.Errorf("DeleteStaleFamilies returned wrong result: got %v, %v want 1, nil", deleted, err)
+	}
+
+	// Expired tokens are deleted
+	if deleted, err := c.DeleteStaleTokens(ctx, future, past, 10); err != nil || deleted != 2 {
+		t.Errorf("DeleteStaleTokens returned wrong result: got %v, %v want 2, nil", deleted, err)
+	}
+	if _, err := s.GetRefreshToken(ctx, ids[2]); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetRefreshToken of deleted token returned wrong error: got %v want %v", err, models.ErrNotFound)
+	}
+
+	if deleted, err := c.DeleteExpiredDeniedTokens(ctx, time.Now(), 10); err != nil || deleted != 1 {
+		t.Errorf("DeleteExpiredDeniedTokens returned wrong result: got %v, %v want 1, nil", deleted, err)
+	}
+	if denied, _ := s.IsAccessTokenDenied(ctx, "valid"); !denied {
+		t.Errorf("DeleteExpiredDeniedTokens deleted not expired token")
+	}
+}
+
+func testActiveSessions(t *testing.T, s service.IDatabase) {
+	c, ok := s.(sessionCounter)
+	if !ok {
+		t.Skip("storage doesn't count sessions")
+	}
+	ctx := context.Background()
+	guid := uuid.New()
+	if err := s.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Three families: refreshed one, revoked one and one with revoked head token
+	var ids []int
+	for i := 0; i < 3; i++ {
+		familyId, err := s.AddTokenFamily(ctx, guid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			id, err := s.AddRefreshToken(ctx, models.RefreshToken{UserId: guid, FamilyId: familyId, Token: []byte(fmt.Sprint("s", i, j))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if _, err := s.MarkRefreshTokenUsed(ctx, ids[len(ids)-2], "1.1.1.1"); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			if err := s.RevokeTokenFamily(ctx, familyId); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.RevokeRefreshToken(ctx, ids[5]); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, err := c.CountActiveSessions(ctx, time.Now().Add(-time.Hour)); err != nil || count != 1 {
+		t.Errorf("CountActiveSessions returned wrong result: got %v, %v want 1, nil", count, err)
+	}
+	// Sessions whose tokens were created before createdAfter are expired
+	if count, err := c.CountActiveSessions(ctx, time.Now().Add(time.Hour)); err != nil || count != 0 {
+		t.Errorf("CountActiveSessions returned wrong result: got %v, %v want 0, nil", count, err)
+	}
+}
+
+func testIPChangeAudit(t *testing.T, s service.IDatabase) {
+	ctx := context.Background()
+	guid := uuid.New()
+	if err := s.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	familyId, err := s.AddTokenFamily(ctx, guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.AddIPChangeEvent(ctx, models.IPChangeEvent{UserId: uuid.New(), FamilyId: familyId,
+		OldIp: "1.1.1.1", NewIp: "2.2.2.2", Action: models.IPChangeWarn, Rule: "ip_change"})
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("AddIPChangeEvent of unknown user returned wrong error: got %v want %v", err, models.ErrNotFound)
+	}
+
+	events := []models.IPChangeEvent{
+		{UserId: guid, FamilyId: familyId, OldIp: "1.1.1.1", NewIp: "1.1.1.2", Action: models.IPChangeAllow, Rule: "subnet"},
+		{UserId: guid, FamilyId: familyId, OldIp: "1.1.1.2", NewIp: "2001:db8::1", OldASN: 4294967295, NewASN: 64500,
+			OldCountry: "DE", NewCountry: "NL", Action: models.IPChangeBlock, Rule: "country_change"},
+	}
+	for _, event := range events {
+		if err := s.AddIPChangeEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, ok := s.(auditor)
+	if !ok {
+		return
+	}
+	got, err := a.GetIPChangeEvents(ctx, guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(events) {
+		t.Fatalf("GetIPChangeEvents returned wrong number of events: got %v want %v", len(got), len(events))
+	}
+	for i, event := range got {
+		if time.Since(event.CreatedAt) > time.Minute {
+			t.Errorf("event %d has wrong creation time: %v", i, event.CreatedAt)
+		}
+		event.Id, event.CreatedAt = 0, time.Time{}
+		if event != events[i] {
+			t.Errorf("GetIPChangeEvents returned wrong event: got %+v want %+v", event, events[i])
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/google/uuid"
+	"restAuthPart/internal/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory storage with the same semantics as DB.
+// It is meant for local runs and tests, data is lost on restart
+type Memory struct {
+	mu          sync.RWMutex
+	users       map[uuid.UUID]models.User
+	families    map[uuid.UUID]*memoryFamily
+	tokens      map[int]*models.RefreshToken
+	lastTokenId int
+	denied      map[string]time.Time
+	audit       []models.IPChangeEvent
+}
+
+// memoryFamily is a row of token_families
+type memoryFamily struct {
+	id        uuid.UUID
+	userId    uuid.UUID
+	createdAt time.Time
+	revokedAt *time.Time
+}
+
+// NewMemory ...
+func NewMemory() *Memory {
+	return &Memory{
+		users:    make(map[uuid.UUID]models.User),
+		families: make(map[uuid.UUID]*memoryFamily),
+		tokens:   make(map[int]*models.RefreshToken),
+		denied:   make(map[string]time.Time),
+	}
+}
+
+// Ping always succeeds
+func (m *Memory) Ping(_ context.Context) error {
+	return nil
+}
+
+// Close ...
+func (m *Memory) Close() {}
+
+// timePtr returns pointer to copy of t
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+// copyTime returns pointer to copy of *t so stored rows can't be changed by callers
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	return timePtr(*t)
+}
+
+// AddUserIfNotExist adds user and updates its ip if it exists.
+// Stored email is kept if user.Email is empty
+func (m *Memory) AddUserIfNotExist(_ context.Context, user models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.users[user.Guid]
+	if !ok {
+		m.users[user.Guid] = models.User{Guid: user.Guid, Ip: user.Ip, Email: user.Email}
+		return nil
+	}
+	stored.Ip = user.Ip
+	if user.Email != "" {
+		stored.Email = user.Email
+	}
+	m.users[user.Guid] = stored
+	return nil
+}
+
+// AddTokenFamily creates a new family for refresh tokens of one login
+func (m *Memory) AddTokenFamily(_ context.Context, guid uuid.UUID) (uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[guid]; !ok {
+		return uuid.Nil, fmt.Errorf("user %s: %w", guid, models.ErrNotFound)
+	}
+
+	familyId := uuid.New()
+	m.families[familyId] = &memoryFamily{id: familyId, userId: guid, createdAt: time.Now()}
+	return familyId, nil
+}
+
+// AddRefreshToken adds token and returns its id. token.Token must be hash of the token
+func (m *Memory) AddRefreshToken(_ context.Context, token models.RefreshToken) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[token.UserId]; !ok {
+		return 0, fmt.Errorf("user %s: %w", token.UserId, models.ErrNotFound)
+	}
+	if _, ok := m.families[token.FamilyId]; !ok {
+		return 0, fmt.Errorf("token family %s: %w", token.FamilyId, models.ErrNotFound)
+	}
+	for _, stored := range m.tokens {
+		if bytes.Equal(stored.Token, token.Token) {
+			return 0, models.ErrDuplicate
+		}
+	}
+
+	m.lastTokenId++
+	m.tokens[m.lastTokenId] = &models.RefreshToken{
+		Id:        m.lastTokenId,
+		UserId:    token.UserId,
+		FamilyId:  token.FamilyId,
+		Token:     bytes.Clone(token.Token),
+		CreatedAt: time.Now(),
+		CreatedIp: token.CreatedIp,
+		UserAgent: token.UserAgent,
+	}
+	return m.lastTokenId, nil
+}
+
+// RehashLegacyTokens replaces plaintext tokens with their hashes, see DB.RehashLegacyTokens
+func (m *Memory) RehashLegacyTokens(_ context.Context, hash func(token string) []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rehashed := 0
+	for _, token := range m.tokens {
+		if len(token.Token) != sha256.Size {
+			token.Token = hash(string(token.Token))
+			rehashed++
+		}
+	}
+	return rehashed, nil
+}
+
+// refreshToken returns copy of stored token joined with its family. Must be called with mu held
+func (m *Memory) refreshToken(token *models.RefreshToken) models.RefreshToken {
+	family := m.families[token.FamilyId]
+
+	result := *token
+	result.Token = bytes.Clone(token.Token)
+	result.SessionCreatedAt = family.createdAt
+	result.UsedAt = copyTime(token.UsedAt)
+	result.RevokedAt = copyTime(token.RevokedAt)
+	if result.RevokedAt == nil {
+		result.RevokedAt = copyTime(family.revokedAt)
+	}
+	result.LastUsedAt = copyTime(token.LastUsedAt)
+	return result
+}
+
+// GetRefreshToken returns token by id
+func (m *Memory) GetRefreshToken(_ context.Context, refreshTokenId int) (models.RefreshToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, ok := m.tokens[refreshTokenId]
+	if !ok {
+		return models.RefreshToken{}, models.ErrNotFound
+	}
+	return m.refreshToken(token), nil
+}
+
+// GetRefreshTokenByHash returns token by hash of the token
+func (m *Memory) GetRefreshTokenByHash(_ context.Context, tokenHash []byte) (models.RefreshToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, token := range m.tokens {
+		if bytes.Equal(token.Token, tokenHash) {
+			return m.refreshToken(token), nil
+		}
+	}
+	return models.RefreshToken{}, models.ErrNotFound
+}
+
+// MarkRefreshTokenUsed sets UsedAt, LastUsedAt and LastIp of token.
+// Returns false if the token was already used
+func (m *Memory) MarkRefreshTokenUsed(_ context.Context, refreshTokenId int, ip string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[refreshTokenId]
+	if !ok || token.UsedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	token.UsedAt = timePtr(now)
+	token.LastUsedAt = timePtr(now)
+	token.LastIp = ip
+	return true, nil
+}
+
+// RevokeTokenFamily revokes all refresh tokens of the family
+func (m *Memory) RevokeTokenFamily(_ context.Context, familyId uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if family, ok := m.families[familyId]; ok && family.revokedAt == nil {
+		family.revokedAt = timePtr(time.Now())
+	}
+	return nil
+}
+
+// RevokeRefreshToken sets RevokedAt of token
+func (m *Memory) RevokeRefreshToken(_ context.Context, refreshTokenId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if token, ok := m.tokens[refreshTokenId]; ok && token.RevokedAt == nil {
+		token.RevokedAt = timePtr(time.Now())
+	}
+	return nil
+}
+
+// DenyAccessToken adds access token id to the deny-list until the token expires
+func (m *Memory) DenyAccessToken(_ context.Context, jti string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.denied[jti]; !ok {
+		m.denied[jti] = expiresAt
+	}
+	return nil
+}
+
+// AddIPChangeEvent appends decision of ip change policy to the audit trail
+func (m *Memory) AddIPChangeEvent(_ context.Context, event models.IPChangeEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[event.UserId]; !ok {
+		return fmt.Errorf("user %s: %w", event.UserId, models.ErrNotFound)
+	}
+
+	event.Id = len(m.audit) + 1
+	event.CreatedAt = time.Now()
+	m.audit = append(m.audit, event)
+	return nil
+}
+
+// GetIPChangeEvents returns audit trail of ip changes of user, oldest first
+func (m *Memory) GetIPChangeEvents(_ context.Context, guid uuid.UUID) ([]models.IPChangeEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	events := make([]models.IPChangeEvent, 0)
+	for _, event := range m.audit {
+		if event.UserId == guid {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// IsAccessTokenDenied reports whether access token id is in the deny-list
+func (m *Memory) IsAccessTokenDenied(_ context.Context, jti string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.denied[jti]
+	return ok, nil
+}
+
+// GetSessions returns not revoked token families of user with their unused token created after createdAfter
+func (m *Memory) GetSessions(_ context.Context, guid uuid.UUID, createdAfter time.Time) ([]models.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Tokens of every family ordered by id
+	byFamily := make(map[uuid.UUID][]*models.RefreshToken)
+	for _, token := range m.tokens {
+		byFamily[token.FamilyId] = append(byFamily[token.FamilyId], token)
+	}
+
+	sessions := make([]models.Session, 0)
+	for _, family := range m.families {
+		if family.userId != guid || family.revokedAt != nil {
+			continue
+		}
+		tokens := byFamily[family.id]
+		sort.Slice(tokens, func(i, j int) bool { return tokens[i].Id < tokens[j].Id })
+
+		var lastUsedAt *time.Time
+		for _, token := range tokens {
+			if token.LastUsedAt != nil && (lastUsedAt == nil || token.LastUsedAt.After(*lastUsedAt)) {
+				lastUsedAt = token.LastUsedAt
+			}
+		}
+
+		for _, head := range tokens {
+			if head.UsedAt != nil || head.RevokedAt != nil || !head.CreatedAt.After(createdAfter) {
+				continue
+			}
+			sessions = append(sessions, models.Session{
+				Id:         family.id,
+				CreatedAt:  family.createdAt,
+				LastUsedAt: copyTime(lastUsedAt),
+				CreatedIp:  tokens[0].CreatedIp,
+				LastIp:     head.CreatedIp,
+				UserAgent:  head.UserAgent,
+				RefreshId:  head.Id,
+			})
+		}
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+// CountActiveSessions counts not revoked token families having unused token created after createdAfter
+func (m *Memory) CountActiveSessions(_ context.Context, createdAfter time.Time) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	active := make(map[uuid.UUID]bool)
+	for _, token := range m.tokens {
+		family := m.families[token.FamilyId]
+		if family == nil || family.revokedAt != nil || token.UsedAt != nil || token.RevokedAt != nil {
+			continue
+		}
+		if token.CreatedAt.After(createdAfter) {
+			active[family.id] = true
+		}
+	}
+	return len(active), nil
+}
+
+// RevokeSession revokes token family of user. Returns false if there is no such active family
+func (m *Memory) RevokeSession(_ context.Context, guid uuid.UUID, sessionId uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	family, ok := m.families[sessionId]
+	if !ok || family.userId != guid || family.revokedAt != nil {
+		return false, nil
+	}
+	family.revokedAt = timePtr(time.Now())
+	return true, nil
+}
+
+// GetUser returns user by guid
+func (m *Memory) GetUser(_ context.Context, guid uuid.UUID) (models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[guid]
+	if !ok {
+		return models.User{}, models.ErrNotFound
+	}
+	user.RevokedBefore = copyTime(user.RevokedBefore)
+	return user, nil
+}
+
+// RevokeUserTokens revokes all token families of user and sets its RevokedBefore
+func (m *Memory) RevokeUserTokens(_ context.Context, guid uuid.UUID, revokedBefore time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[guid]
+	if !ok {
+		return models.ErrNotFound
+	}
+	user.RevokedBefore = timePtr(revokedBefore)
+	m.users[guid] = user
+
+	now := time.Now()
+	for _, family := range m.families {
+		if family.userId == guid && family.revokedAt == nil {
+			family.revokedAt = timePtr(now)
+		}
+	}
+	return nil
+}
+
+// DeleteStaleTokens deletes at most limit tokens created before expiredBefore
+// or revoked with their family before revokedBefore
+func (m *Memory) DeleteStaleTokens(_ context.Context, expiredBefore, revokedBefore time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for id, token := range m.tokens {
+		if deleted == limit {
+			break
+		}
+		revokedAt := token.RevokedAt
+		if revokedAt == nil {
+			revokedAt = m.families[token.FamilyId].revokedAt
+		}
+		if token.CreatedAt.Before(expiredBefore) || (revokedAt != nil && revokedAt.Before(revokedBefore)) {
+			delete(m.tokens, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// DeleteStaleFamilies deletes at most limit token families created before createdBefore
+// which have no tokens left
+func (m *Memory) DeleteStaleFamilies(_ context.Context, createdBefore time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	used := make(map[uuid.UUID]bool)
+	for _, token := range m.tokens {
+		used[token.FamilyId] = true
+	}
+
+	deleted := 0
+	for id, family := range m.families {
+		if deleted == limit {
+			break
+		}
+		if family.createdAt.Before(createdBefore) && !used[id] {
+			delete(m.families, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// DeleteExpiredDeniedTokens deletes at most limit denied access tokens expired before expiredBefore
+func (m *Memory) DeleteExpiredDeniedTokens(_ context.Context, expiredBefore time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for jti, expiresAt := range m.denied {
+		if deleted == limit {
+			break
+		}
+		if expiresAt.Before(expiredBefore) {
+			delete(m.denied, jti)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
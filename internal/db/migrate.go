@@ -0,0 +1,273 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+// migrationsLockKey is the key of Postgres advisory lock held while migrating,
+// so only one replica applies migrations
+const migrationsLockKey = 7243178210
+
+// migration is a versioned schema change read from <version>_<name>.(up|down).sql files
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations reads migrations from dir of migrationsFS sorted by version
+func loadMigrations(dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("unexpected migration file %q", entry.Name())
+		}
+		versionStr, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("bad version of migration %q: %w", entry.Name(), err)
+		}
+
+		data, err := fs.ReadFile(migrationsFS, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d must have both up and down files", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// step is a migration to apply in the given direction
+type step struct {
+	migration
+	up bool
+}
+
+// migrationPlan chooses steps to apply from migrations and versions already applied
+type migrationPlan func(migrations []migration, applied map[int]bool) []step
+
+// upPlan applies all pending migrations
+func upPlan(migrations []migration, applied map[int]bool) []step {
+	var steps []step
+	for _, m := range migrations {
+		if !applied[m.version] {
+			steps = append(steps, step{migration: m, up: true})
+		}
+	}
+	return steps
+}
+
+// downPlan reverts n last applied migrations
+func downPlan(n int) migrationPlan {
+	return func(migrations []migration, applied map[int]bool) []step {
+		var steps []step
+		for i := len(migrations) - 1; i >= 0 && len(steps) < n; i-- {
+			if applied[migrations[i].version] {
+				steps = append(steps, step{migration: migrations[i], up: false})
+			}
+		}
+		return steps
+	}
+}
+
+// MigrateUp applies all pending migrations
+func (d *DB) MigrateUp(ctx context.Context) error {
+	return d.migrate(ctx, upPlan)
+}
+
+// MigrateDown reverts n last applied migrations
+func (d *DB) MigrateDown(ctx context.Context, n int) error {
+	return d.migrate(ctx, downPlan(n))
+}
+
+// migrate applies steps chosen by plan under advisory lock.
+// Each step runs in its own transaction together with schema_migrations update
+func (d *DB) migrate(ctx context.Context, plan migrationPlan) error {
+	migrations, err := loadMigrations("migrations/postgres")
+	if err != nil {
+		return err
+	}
+
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationsLockKey); err != nil {
+		return err
+	}
+	defer conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationsLockKey)
+
+	if _, err := conn.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS public.schema_migrations (
+			 version bigint NOT NULL PRIMARY KEY,
+			 name text NOT NULL,
+			 applied_at timestamp with time zone DEFAULT now() NOT NULL
+		 )`); err != nil {
+		return err
+	}
+
+	rows, err := conn.Query(ctx, `SELECT version FROM public.schema_migrations`)
+	if err != nil {
+		return err
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range plan(migrations, applied) {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+
+		sql, record, args := s.migration.up, `INSERT INTO public.schema_migrations (version, name) VALUES ($1, $2)`, []any{s.version, s.name}
+		if !s.up {
+			sql, record, args = s.migration.down, `DELETE FROM public.schema_migrations WHERE version=$1`, []any{s.version}
+		}
+
+		if _, err := tx.Exec(ctx, sql); err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("migration %d_%s: %w", s.version, s.name, err)
+		}
+		if _, err := tx.Exec(ctx, record, args...); err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+
+		logStep(s)
+	}
+
+	return nil
+}
+
+// logStep logs applied step
+func logStep(s step) {
+	slog.Info("Migration applied", slog.Int("version", s.version),
+		slog.String("name", s.name), slog.Bool("up", s.up))
+}
+
+// MigrateUp applies all pending migrations
+func (s *SQLite) MigrateUp(ctx context.Context) error {
+	return s.migrate(ctx, upPlan)
+}
+
+// MigrateDown reverts n last applied migrations
+func (s *SQLite) MigrateDown(ctx context.Context, n int) error {
+	return s.migrate(ctx, downPlan(n))
+}
+
+// migrate applies steps chosen by plan. SQLite storage has a single connection,
+// so unlike Postgres no lock is needed
+func (s *SQLite) migrate(ctx context.Context, plan migrationPlan) error {
+	migrations, err := loadMigrations("migrations/sqlite")
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			 version integer NOT NULL PRIMARY KEY,
+			 name text NOT NULL,
+			 applied_at timestamp NOT NULL
+		 )`); err != nil {
+		return err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, st := range plan(migrations, applied) {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		sql, record, args := st.migration.up, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`, []any{st.version, st.name, now()}
+		if !st.up {
+			sql, record, args = st.migration.down, `DELETE FROM schema_migrations WHERE version=$1`, []any{st.version}
+		}
+
+		if _, err := tx.ExecContext(ctx, sql); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d_%s: %w", st.version, st.name, err)
+		}
+		if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		logStep(st)
+	}
+
+	return nil
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.tokens;
+DROP TABLE IF EXISTS public.users;
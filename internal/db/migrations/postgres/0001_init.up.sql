@@ -0,0 +1,17 @@
+-- Schema of the original pg_dump init script. IF NOT EXISTS lets databases
+-- created by that script adopt migrations
+CREATE TABLE IF NOT EXISTS public.users (
+    id uuid NOT NULL,
+    ip character varying(100) NOT NULL,
+    mail character varying(100),
+    CONSTRAINT users_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS public.tokens (
+    id serial NOT NULL,
+    user_id uuid NOT NULL,
+    token bytea NOT NULL,
+    CONSTRAINT tokens_pkey PRIMARY KEY (id),
+    CONSTRAINT tokens_token_key UNIQUE (token),
+    CONSTRAINT tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id)
+);
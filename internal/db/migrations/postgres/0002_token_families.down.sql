@@ -0,0 +1,7 @@
+ALTER TABLE public.tokens
+    DROP COLUMN family_id,
+    DROP COLUMN created_at,
+    DROP COLUMN used_at,
+    DROP COLUMN revoked_at;
+
+DROP TABLE public.token_families;
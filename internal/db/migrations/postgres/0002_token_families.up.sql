@@ -0,0 +1,22 @@
+CREATE TABLE public.token_families (
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    revoked_at timestamp with time zone,
+    CONSTRAINT token_families_pkey PRIMARY KEY (id),
+    CONSTRAINT token_families_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id)
+);
+
+ALTER TABLE public.tokens
+    ADD COLUMN family_id uuid,
+    ADD COLUMN created_at timestamp with time zone DEFAULT now() NOT NULL,
+    ADD COLUMN used_at timestamp with time zone,
+    ADD COLUMN revoked_at timestamp with time zone;
+
+-- Every token issued before rotation is a session of its own
+UPDATE public.tokens SET family_id = gen_random_uuid();
+INSERT INTO public.token_families (id, user_id) SELECT family_id, user_id FROM public.tokens;
+
+ALTER TABLE public.tokens
+    ALTER COLUMN family_id SET NOT NULL,
+    ADD CONSTRAINT tokens_family_id_fkey FOREIGN KEY (family_id) REFERENCES public.token_families(id);
@@ -0,0 +1,3 @@
+DROP TABLE public.denied_tokens;
+
+ALTER TABLE public.users DROP COLUMN revoked_before;
@@ -0,0 +1,7 @@
+ALTER TABLE public.users ADD COLUMN revoked_before timestamp with time zone;
+
+CREATE TABLE public.denied_tokens (
+    jti character varying(100) NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    CONSTRAINT denied_tokens_pkey PRIMARY KEY (jti)
+);
@@ -0,0 +1,5 @@
+ALTER TABLE public.tokens
+    DROP COLUMN last_used_at,
+    DROP COLUMN created_ip,
+    DROP COLUMN last_ip,
+    DROP COLUMN user_agent;
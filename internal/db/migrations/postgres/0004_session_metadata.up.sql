@@ -0,0 +1,5 @@
+ALTER TABLE public.tokens
+    ADD COLUMN last_used_at timestamp with time zone,
+    ADD COLUMN created_ip character varying(100) DEFAULT ''::character varying NOT NULL,
+    ADD COLUMN last_ip character varying(100),
+    ADD COLUMN user_agent text DEFAULT ''::text NOT NULL;
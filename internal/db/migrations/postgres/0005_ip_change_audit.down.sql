@@ -0,0 +1 @@
+DROP TABLE public.ip_change_audit;
@@ -0,0 +1,20 @@
+-- Audit trail of ip change policy decisions. family_id has no foreign key,
+-- so records outlive sessions deleted by the janitor
+CREATE TABLE public.ip_change_audit (
+    id serial NOT NULL,
+    user_id uuid NOT NULL,
+    family_id uuid NOT NULL,
+    old_ip character varying(100) NOT NULL,
+    new_ip character varying(100) NOT NULL,
+    old_asn bigint,
+    new_asn bigint,
+    old_country character varying(2),
+    new_country character varying(2),
+    action character varying(20) NOT NULL,
+    rule character varying(50) NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    CONSTRAINT ip_change_audit_pkey PRIMARY KEY (id),
+    CONSTRAINT ip_change_audit_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id)
+);
+
+CREATE INDEX ip_change_audit_user_id_idx ON public.ip_change_audit (user_id, created_at);
@@ -0,0 +1,4 @@
+DROP TABLE denied_tokens;
+DROP TABLE tokens;
+DROP TABLE token_families;
+DROP TABLE users;
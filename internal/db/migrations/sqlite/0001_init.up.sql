@@ -0,0 +1,35 @@
+-- Schema matching Postgres migrations 0001-0004. SQLite can't add NOT NULL
+-- columns to existing tables, so its migrations are versioned separately.
+-- uuids are stored as text, timestamps as UTC text in SQLite format
+CREATE TABLE users (
+    id text NOT NULL PRIMARY KEY,
+    ip text NOT NULL,
+    mail text,
+    revoked_before timestamp
+);
+
+CREATE TABLE token_families (
+    id text NOT NULL PRIMARY KEY,
+    user_id text NOT NULL REFERENCES users(id),
+    created_at timestamp NOT NULL,
+    revoked_at timestamp
+);
+
+CREATE TABLE tokens (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id text NOT NULL REFERENCES users(id),
+    token blob NOT NULL UNIQUE,
+    family_id text NOT NULL REFERENCES token_families(id),
+    created_at timestamp NOT NULL,
+    used_at timestamp,
+    revoked_at timestamp,
+    last_used_at timestamp,
+    created_ip text NOT NULL DEFAULT '',
+    last_ip text,
+    user_agent text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE denied_tokens (
+    jti text NOT NULL PRIMARY KEY,
+    expires_at timestamp NOT NULL
+);
@@ -0,0 +1 @@
+DROP TABLE ip_change_audit;
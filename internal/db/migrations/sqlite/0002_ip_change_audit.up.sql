@@ -0,0 +1,17 @@
+-- Audit trail of ip change policy decisions, see Postgres migration 0005
+CREATE TABLE ip_change_audit (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id text NOT NULL REFERENCES users(id),
+    family_id text NOT NULL,
+    old_ip text NOT NULL,
+    new_ip text NOT NULL,
+    old_asn integer,
+    new_asn integer,
+    old_country text,
+    new_country text,
+    action text NOT NULL,
+    rule text NOT NULL,
+    created_at timestamp NOT NULL
+);
+
+CREATE INDEX ip_change_audit_user_id_idx ON ip_change_audit (user_id, created_at);
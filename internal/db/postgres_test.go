@@ -0,0 +1,127 @@
+//go:build postgres
+
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/ilyakaznacheev/cleanenv"
+	"os"
+	"restAuthPart/internal/db/dbtest"
+	"restAuthPart/internal/models"
+	"restAuthPart/internal/service"
+	"testing"
+	"time"
+)
+
+// testConfig defaults to Postgres started with `docker compose --profile test up -d db_test`.
+// Tables are truncated, never point it to a database with data
+type testConfig struct {
+	Host     string `env:"TEST_DB_HOST" env-default:"localhost"`
+	Port     string `env:"TEST_DB_PORT" env-default:"5435"`
+	User     string `env:"TEST_DB_USER" env-default:"baseuser"`
+	Password string `env:"TEST_DB_PASSWORD" env-default:"basepassword"`
+	DbName   string `env:"TEST_DB_NAME" env-default:"testtask_test"`
+}
+
+// newTestDB connects to the test database
+func newTestDB(t *testing.T) *DB {
+	var cfg testConfig
+	if err := cleanenv.ReadEnv(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(context.Background(), &Config{
+		Host:     cfg.Host,
+		Port:     cfg.Port,
+		User:     cfg.User,
+		Password: cfg.Password,
+		DbName:   cfg.DbName,
+		MaxConns: 10,
+		// pgxpool panics on zero period
+		HealthCheckPeriod: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	return d
+}
+
+func TestPostgres(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDB(t)
+	if err := d.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dbtest.Run(t, func(t *testing.T) service.IDatabase {
+		if _, err := d.db.Exec(ctx,
+			`TRUNCATE public.users, public.token_families, public.tokens, public.denied_tokens, public.ip_change_audit RESTART IDENTITY CASCADE`); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDB(t)
+
+	// Database created by the original init script with a session in it
+	initSQL, err := os.ReadFile("testdata/init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	for _, sql := range []string{`DROP SCHEMA public CASCADE`, `CREATE SCHEMA public`, string(initSQL)} {
+		if _, err := d.db.Exec(ctx, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.db.Exec(ctx, `INSERT INTO public.users (id, ip) VALUES ($1, '1.1.1.1')`, guid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Exec(ctx, `INSERT INTO public.tokens (user_id, token) VALUES ($1, 'legacy')`, guid); err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing schema is adopted and the token becomes a session of its own
+	if err := d.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := d.GetSessions(ctx, guid, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Errorf("GetSessions returned wrong number of adopted sessions: got %v want 1", len(sessions))
+	}
+
+	// Migrations can be reverted and applied again
+	if err := d.MigrateDown(ctx, len(mustLoadMigrations(t))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetUser(ctx, guid); err == nil {
+		t.Errorf("GetUser succeeded after migrations were reverted")
+	}
+	if err := d.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MigrateUp(ctx); err != nil {
+		t.Errorf("MigrateUp without pending migrations returned error: %v", err)
+	}
+	if _, err := d.GetUser(ctx, guid); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetUser returned wrong error after migrations were applied again: got %v want %v", err, models.ErrNotFound)
+	}
+}
+
+// mustLoadMigrations returns embedded Postgres migrations
+func mustLoadMigrations(t *testing.T) []migration {
+	migrations, err := loadMigrations("migrations/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrations
+}
@@ -0,0 +1,428 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"restAuthPart/internal/models"
+	"time"
+)
+
+// SQLite is a storage in SQLite file with the same semantics as DB.
+// It is meant for single node deployments
+type SQLite struct {
+	cfg *Config
+	db  *sql.DB
+}
+
+// NewSQLite ...
+func NewSQLite(ctx context.Context, cfg *Config) (*SQLite, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf(
+		"file:%s?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_time_format=sqlite",
+		cfg.Path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, single connection makes
+	// transactions wait for each other instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLite{
+		cfg: cfg,
+		db:  db,
+	}, nil
+}
+
+// Ping checks that database is reachable
+func (s *SQLite) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// PoolStats returns usage of connection pool
+func (s *SQLite) PoolStats() PoolStats {
+	stats := s.db.Stats()
+	return PoolStats{
+		Max:   stats.MaxOpenConnections,
+		Total: stats.OpenConnections,
+		Idle:  stats.Idle,
+		InUse: stats.InUse,
+	}
+}
+
+// Close ...
+func (s *SQLite) Close() {
+	s.db.Close()
+}
+
+// sqliteNotFound replaces sql.ErrNoRows with models.ErrNotFound
+func sqliteNotFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ErrNotFound
+	}
+	return err
+}
+
+// sqliteConstraintError replaces unique and foreign key violations
+// with models.ErrDuplicate and models.ErrNotFound
+func sqliteConstraintError(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	switch sqliteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		return fmt.Errorf("%s: %w", sqliteErr.Error(), models.ErrDuplicate)
+	case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+		return fmt.Errorf("%s: %w", sqliteErr.Error(), models.ErrNotFound)
+	}
+	return err
+}
+
+// now returns current time in UTC. Timestamps are stored as text,
+// same zone keeps them comparable
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// nullTime scans nullable timestamp. SQLite returns expressions
+// over timestamp columns like COALESCE or max as text, they are parsed here
+type nullTime struct {
+	t *time.Time
+}
+
+// Scan implements sql.Scanner
+func (n *nullTime) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		n.t = nil
+		return nil
+	case time.Time:
+		n.t = &v
+		return nil
+	case string:
+		for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05", time.RFC3339Nano} {
+			if t, err := time.Parse(layout, v); err == nil {
+				n.t = &t
+				return nil
+			}
+		}
+		return fmt.Errorf("cannot parse timestamp %q", v)
+	default:
+		return fmt.Errorf("cannot scan %T into timestamp", src)
+	}
+}
+
+// AddUserIfNotExist insert models.User to table users and update its ip if it exists.
+// Stored email is kept if user.Email is empty
+func (s *SQLite) AddUserIfNotExist(ctx context.Context, user models.User) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO users (id, ip, mail)
+			 VALUES ($1, $2, NULLIF($3, ''))
+			 ON CONFLICT (id) DO UPDATE SET ip=$2, mail=COALESCE(NULLIF($3, ''), users.mail)`,
+		user.Guid, user.Ip, user.Email,
+	)
+	return err
+}
+
+// AddTokenFamily creates a new family for refresh tokens of one login
+func (s *SQLite) AddTokenFamily(ctx context.Context, guid uuid.UUID) (uuid.UUID, error) {
+	familyId := uuid.New()
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO token_families (id, user_id, created_at) VALUES ($1, $2, $3)`, familyId, guid, now())
+	return familyId, sqliteConstraintError(err)
+}
+
+// AddRefreshToken insert token to table tokens. token.Token must be hash of the token
+func (s *SQLite) AddRefreshToken(ctx context.Context, token models.RefreshToken) (int, error) {
+	var id int
+
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO tokens (user_id, token, family_id, created_at, created_ip, user_agent)
+			 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		token.UserId, token.Token, token.FamilyId, now(), token.CreatedIp, token.UserAgent).Scan(&id)
+	return id, sqliteConstraintError(err)
+}
+
+// RehashLegacyTokens replaces plaintext tokens with their hashes, see DB.RehashLegacyTokens
+func (s *SQLite) RehashLegacyTokens(ctx context.Context, hash func(token string) []byte) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, token FROM tokens WHERE length(token) <> $1`, sha256.Size)
+	if err != nil {
+		return 0, err
+	}
+	legacy := make(map[int][]byte)
+	for rows.Next() {
+		var id int
+		var token []byte
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		legacy[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, token := range legacy {
+		if _, err := tx.ExecContext(ctx, `UPDATE tokens SET token=$1 WHERE id=$2`, hash(string(token)), id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(legacy), tx.Commit()
+}
+
+// sqliteRefreshTokenSelect selects models.RefreshToken fields, see scanSQLiteRefreshToken.
+// Token is revoked if either it or its family is revoked
+const sqliteRefreshTokenSelect = `SELECT t.id, t.user_id, t.family_id, f.created_at, t.token, t.created_at, t.used_at,
+			        COALESCE(t.revoked_at, f.revoked_at), t.last_used_at, t.created_ip, COALESCE(t.last_ip, ''), t.user_agent
+			 FROM tokens t JOIN token_families f ON f.id = t.family_id`
+
+// scanSQLiteRefreshToken scans row selected with sqliteRefreshTokenSelect
+func scanSQLiteRefreshToken(row *sql.Row) (models.RefreshToken, error) {
+	var token models.RefreshToken
+	var revokedAt nullTime
+	err := row.Scan(&token.Id, &token.UserId, &token.FamilyId, &token.SessionCreatedAt, &token.Token, &token.CreatedAt, &token.UsedAt,
+		&revokedAt, &token.LastUsedAt, &token.CreatedIp, &token.LastIp, &token.UserAgent)
+	token.RevokedAt = revokedAt.t
+	return token, sqliteNotFound(err)
+}
+
+// GetRefreshToken returns token from table tokens by id
+func (s *SQLite) GetRefreshToken(ctx context.Context, refreshTokenId int) (models.RefreshToken, error) {
+	return scanSQLiteRefreshToken(s.db.QueryRowContext(ctx,
+		sqliteRefreshTokenSelect+` WHERE t.id=$1`, refreshTokenId))
+}
+
+// GetRefreshTokenByHash returns token from table tokens by hash of the token
+func (s *SQLite) GetRefreshTokenByHash(ctx context.Context, tokenHash []byte) (models.RefreshToken, error) {
+	return scanSQLiteRefreshToken(s.db.QueryRowContext(ctx,
+		sqliteRefreshTokenSelect+` WHERE t.token=$1`, tokenHash))
+}
+
+// MarkRefreshTokenUsed sets used_at, last_used_at and last_ip of token.
+// Returns false if the token was already used
+func (s *SQLite) MarkRefreshTokenUsed(ctx context.Context, refreshTokenId int, ip string) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE tokens SET used_at=$3, last_used_at=$3, last_ip=$2
+			 WHERE id=$1 AND used_at IS NULL`, refreshTokenId, ip, now())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// RevokeTokenFamily revokes all refresh tokens of the family
+func (s *SQLite) RevokeTokenFamily(ctx context.Context, familyId uuid.UUID) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE token_families SET revoked_at=$2 WHERE id=$1 AND revoked_at IS NULL`, familyId, now())
+	return err
+}
+
+// RevokeRefreshToken sets revoked_at of token
+func (s *SQLite) RevokeRefreshToken(ctx context.Context, refreshTokenId int) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE tokens SET revoked_at=$2 WHERE id=$1 AND revoked_at IS NULL`, refreshTokenId, now())
+	return err
+}
+
+// DenyAccessToken adds access token id to table denied_tokens until the token expires
+func (s *SQLite) DenyAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO denied_tokens (jti, expires_at) VALUES ($1, $2)
+			 ON CONFLICT (jti) DO NOTHING`, jti, expiresAt.UTC())
+	return err
+}
+
+// AddIPChangeEvent inserts decision of ip change policy to table ip_change_audit
+func (s *SQLite) AddIPChangeEvent(ctx context.Context, event models.IPChangeEvent) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO ip_change_audit
+			 (user_id, family_id, old_ip, new_ip, old_asn, new_asn, old_country, new_country, action, rule, created_at)
+			 VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, 0), NULLIF($7, ''), NULLIF($8, ''), $9, $10, $11)`,
+		event.UserId, event.FamilyId, event.OldIp, event.NewIp, int64(event.OldASN), int64(event.NewASN),
+		event.OldCountry, event.NewCountry, event.Action, event.Rule, now())
+	return sqliteConstraintError(err)
+}
+
+// GetIPChangeEvents returns audit trail of ip changes of user, oldest first
+func (s *SQLite) GetIPChangeEvents(ctx context.Context, guid uuid.UUID) ([]models.IPChangeEvent, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, user_id, family_id, old_ip, new_ip, COALESCE(old_asn, 0), COALESCE(new_asn, 0),
+			        COALESCE(old_country, ''), COALESCE(new_country, ''), action, rule, created_at
+			 FROM ip_change_audit WHERE user_id=$1 ORDER BY id`, guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]models.IPChangeEvent, 0)
+	for rows.Next() {
+		var event models.IPChangeEvent
+		var oldASN, newASN int64
+		if err := rows.Scan(&event.Id, &event.UserId, &event.FamilyId, &event.OldIp, &event.NewIp, &oldASN, &newASN,
+			&event.OldCountry, &event.NewCountry, &event.Action, &event.Rule, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.OldASN, event.NewASN = uint(oldASN), uint(newASN)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// IsAccessTokenDenied reports whether access token id is in table denied_tokens
+func (s *SQLite) IsAccessTokenDenied(ctx context.Context, jti string) (bool, error) {
+	var denied bool
+	err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM denied_tokens WHERE jti=$1)`, jti).Scan(&denied)
+	return denied, err
+}
+
+// GetSessions returns not revoked token families of user with their unused token created after createdAfter
+func (s *SQLite) GetSessions(ctx context.Context, guid uuid.UUID, createdAfter time.Time) ([]models.Session, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT f.id, f.created_at,
+			        (SELECT max(t.last_used_at) FROM tokens t WHERE t.family_id = f.id),
+			        (SELECT t.created_ip FROM tokens t WHERE t.family_id = f.id ORDER BY t.id LIMIT 1),
+			        head.created_ip, head.user_agent, head.id
+			 FROM token_families f
+			 JOIN tokens head ON head.family_id = f.id AND head.used_at IS NULL AND head.revoked_at IS NULL
+			 WHERE f.user_id=$1 AND f.revoked_at IS NULL AND head.created_at > $2
+			 ORDER BY f.created_at DESC`, guid, createdAfter.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]models.Session, 0)
+	for rows.Next() {
+		var session models.Session
+		var lastUsedAt nullTime
+		if err := rows.Scan(&session.Id, &session.CreatedAt, &lastUsedAt, &session.CreatedIp,
+			&session.LastIp, &session.UserAgent, &session.RefreshId); err != nil {
+			return nil, err
+		}
+		session.LastUsedAt = lastUsedAt.t
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// CountActiveSessions counts not revoked token families having unused token created after createdAfter
+func (s *SQLite) CountActiveSessions(ctx context.Context, createdAfter time.Time) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx,
+		`SELECT count(DISTINCT f.id)
+			 FROM token_families f
+			 JOIN tokens head ON head.family_id = f.id AND head.used_at IS NULL AND head.revoked_at IS NULL
+			 WHERE f.revoked_at IS NULL AND head.created_at > $1`, createdAfter.UTC()).Scan(&count)
+	return count, err
+}
+
+// RevokeSession revokes token family of user. Returns false if there is no such active family
+func (s *SQLite) RevokeSession(ctx context.Context, guid uuid.UUID, sessionId uuid.UUID) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE token_families SET revoked_at=$3
+			 WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL`, sessionId, guid, now())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// GetUser returns user from table users
+func (s *SQLite) GetUser(ctx context.Context, guid uuid.UUID) (models.User, error) {
+	var user models.User
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, ip, COALESCE(mail, ''), revoked_before FROM users WHERE id=$1`, guid).Scan(
+		&user.Guid, &user.Ip, &user.Email, &user.RevokedBefore)
+	return user, sqliteNotFound(err)
+}
+
+// RevokeUserTokens revokes all token families of user and sets its revoked_before
+func (s *SQLite) RevokeUserTokens(ctx context.Context, guid uuid.UUID, revokedBefore time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE users SET revoked_before=$2 WHERE id=$1`, guid, revokedBefore.UTC())
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return models.ErrNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE token_families SET revoked_at=$2 WHERE user_id=$1 AND revoked_at IS NULL`, guid, now()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteStaleTokens deletes at most limit tokens created before expiredBefore
+// or revoked with their family before revokedBefore
+func (s *SQLite) DeleteStaleTokens(ctx context.Context, expiredBefore, revokedBefore time.Time, limit int) (int, error) {
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM tokens WHERE id IN (
+			 SELECT t.id FROM tokens t JOIN token_families f ON f.id = t.family_id
+			 WHERE t.created_at < $1 OR COALESCE(t.revoked_at, f.revoked_at) < $2
+			 LIMIT $3)`, expiredBefore.UTC(), revokedBefore.UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
+
+// DeleteStaleFamilies deletes at most limit token families created before createdBefore
+// which have no tokens left
+func (s *SQLite) DeleteStaleFamilies(ctx context.Context, createdBefore time.Time, limit int) (int, error) {
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM token_families WHERE id IN (
+			 SELECT f.id FROM token_families f
+			 WHERE f.created_at < $1 AND NOT EXISTS (SELECT 1 FROM tokens t WHERE t.family_id = f.id)
+			 LIMIT $2)`, createdBefore.UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
+
+// DeleteExpiredDeniedTokens deletes at most limit rows of denied_tokens expired before expiredBefore
+func (s *SQLite) DeleteExpiredDeniedTokens(ctx context.Context, expiredBefore time.Time, limit int) (int, error) {
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM denied_tokens WHERE jti IN (
+			 SELECT jti FROM denied_tokens WHERE expires_at < $1 LIMIT $2)`, expiredBefore.UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"path/filepath"
+	"restAuthPart/internal/db/dbtest"
+	"restAuthPart/internal/service"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) service.IDatabase {
+		return NewMemory()
+	})
+}
+
+func TestSQLite(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) service.IDatabase {
+		s, err := NewSQLite(context.Background(), &Config{Path: filepath.Join(t.TempDir(), "test.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		if err := s.MigrateUp(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewSQLite(ctx, &Config{Path: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Migrations can be reverted and applied again
+	if err := s.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MigrateDown(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser(ctx, uuid.New()); err == nil {
+		t.Errorf("GetUser succeeded after migrations were reverted")
+	}
+	if err := s.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MigrateUp(ctx); err != nil {
+		t.Errorf("MigrateUp without pending migrations returned error: %v", err)
+	}
+}
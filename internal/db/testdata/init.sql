@@ -0,0 +1,37 @@
+-- Schema created by the original pg_dump script db_init/init.sql,
+-- without session settings and owners
+CREATE TABLE public.tokens (
+    id integer NOT NULL,
+    user_id uuid NOT NULL,
+    token bytea NOT NULL
+);
+
+CREATE SEQUENCE public.tokens_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE public.tokens_id_seq OWNED BY public.tokens.id;
+
+CREATE TABLE public.users (
+    id uuid NOT NULL,
+    ip character varying(100) NOT NULL,
+    mail character varying(100)
+);
+
+ALTER TABLE ONLY public.tokens ALTER COLUMN id SET DEFAULT nextval('public.tokens_id_seq'::regclass);
+
+ALTER TABLE ONLY public.tokens
+    ADD CONSTRAINT tokens_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY public.tokens
+    ADD CONSTRAINT tokens_token_key UNIQUE (token);
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY public.tokens
+    ADD CONSTRAINT tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id);
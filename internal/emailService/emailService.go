@@ -1,6 +1,9 @@
 package emailService
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 // Email ...
 type Email struct {
@@ -11,6 +14,11 @@ func New() *Email {
 	return &Email{}
 }
 
+// Ping checks that mail server is reachable. Messages are only printed, so it always succeeds
+func (e *Email) Ping(_ context.Context) error {
+	return nil
+}
+
 // SendWarning ...
 func (e *Email) SendWarning(email string) error {
 	fmt.Printf("Sanding message to email '%s'\n", email)
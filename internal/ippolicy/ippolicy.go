@@ -0,0 +1,238 @@
+package ippolicy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"net/netip"
+	"restAuthPart/internal/models"
+	"strings"
+)
+
+// Rules which decided on ip change, stored in the audit trail
+const (
+	RuleSame          = "same_ip"
+	RuleAllowlist     = "allowlist"
+	RuleSubnet        = "subnet"
+	RuleIPChange      = "ip_change"
+	RuleASNChange     = "asn_change"
+	RuleCountryChange = "country_change"
+)
+
+// severity orders actions, the most severe one of matched rules wins
+var severity = map[string]int{
+	models.IPChangeAllow:  0,
+	models.IPChangeWarn:   1,
+	models.IPChangeReauth: 2,
+	models.IPChangeBlock:  3,
+}
+
+// Config ...
+type Config struct {
+	// Action taken when ip of refresh token owner changed: allow, warn, reauth or block
+	Action string `yaml:"action" env:"ACTION" env-default:"warn"`
+	// IPv4Prefix and IPv6Prefix are lengths of subnets within which ip may change freely.
+	// Zero makes any change of ip count
+	IPv4Prefix int `yaml:"ipv4Prefix" env:"IPV4_PREFIX" env-default:"24"`
+	IPv6Prefix int `yaml:"ipv6Prefix" env:"IPV6_PREFIX" env-default:"64"`
+	// AllowedNetworks are CIDRs or addresses like office or VPN ranges, moving into them is always allowed
+	AllowedNetworks []string `yaml:"allowedNetworks" env:"ALLOWED_NETWORKS"`
+	// ASNDatabase and CountryDatabase are paths to MaxMind mmdb files (GeoLite2-ASN, GeoLite2-Country
+	// or GeoLite2-City). Empty path disables the check
+	ASNDatabase     string `yaml:"asnDatabase" env:"ASN_DATABASE"`
+	CountryDatabase string `yaml:"countryDatabase" env:"COUNTRY_DATABASE"`
+	// ASNChangeAction and CountryChangeAction are taken when ip moved to another network or country.
+	// Empty means Action
+	ASNChangeAction     string `yaml:"asnChangeAction" env:"ASN_CHANGE_ACTION"`
+	CountryChangeAction string `yaml:"countryChangeAction" env:"COUNTRY_CHANGE_ACTION"`
+}
+
+// location is what GeoIP databases know about an address
+type location struct {
+	asn     uint
+	country string
+}
+
+// Policy decides what to do when refresh token is used from another ip
+type Policy struct {
+	cfg           *Config
+	allowed       []netip.Prefix
+	asnReader     *maxminddb.Reader
+	countryReader *maxminddb.Reader
+	// locate looks addresses up in GeoIP databases, replaced in tests
+	locate func(addr netip.Addr) location
+}
+
+// New ...
+func New(cfg *Config) (*Policy, error) {
+	for _, action := range []string{cfg.Action, cfg.ASNChangeAction, cfg.CountryChangeAction} {
+		if _, ok := severity[action]; !ok && action != "" {
+			return nil, fmt.Errorf("unknown ip change action: %q", action)
+		}
+	}
+	if cfg.Action == "" {
+		return nil, errors.New("ip change action is required")
+	}
+	if cfg.IPv4Prefix < 0 || cfg.IPv4Prefix > 32 || cfg.IPv6Prefix < 0 || cfg.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid subnet prefix: /%d, /%d", cfg.IPv4Prefix, cfg.IPv6Prefix)
+	}
+
+	p := &Policy{cfg: cfg}
+	p.locate = p.lookup
+	for _, network := range cfg.AllowedNetworks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(network); err == nil {
+			p.allowed = append(p.allowed, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network: %q", network)
+		}
+		p.allowed = append(p.allowed, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	var err error
+	if cfg.ASNDatabase != "" {
+		if p.asnReader, err = maxminddb.Open(cfg.ASNDatabase); err != nil {
+			return nil, fmt.Errorf("cannot open ASN database: %w", err)
+		}
+	}
+	if cfg.CountryDatabase != "" {
+		if p.countryReader, err = maxminddb.Open(cfg.CountryDatabase); err != nil {
+			p.Close()
+			return nil, fmt.Errorf("cannot open country database: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Close closes GeoIP databases
+func (p *Policy) Close() {
+	if p.asnReader != nil {
+		_ = p.asnReader.Close()
+	}
+	if p.countryReader != nil {
+		_ = p.countryReader.Close()
+	}
+}
+
+// Evaluate decides what to do with refresh from newIp of token issued to oldIp.
+// Returned event has Action, Rule, addresses and their GeoIP data filled
+func (p *Policy) Evaluate(oldIp, newIp string) models.IPChangeEvent {
+	event := models.IPChangeEvent{OldIp: oldIp, NewIp: newIp, Action: models.IPChangeAllow, Rule: RuleSame}
+	oldAddr, oldOk := parseAddr(oldIp)
+	newAddr, newOk := parseAddr(newIp)
+	if oldOk && newOk {
+		// Tokens issued before client ip was resolved contain port
+		event.OldIp, event.NewIp = oldAddr.String(), newAddr.String()
+	}
+	if event.OldIp == event.NewIp {
+		return event
+	}
+
+	if newOk && p.isAllowed(newAddr) {
+		event.Rule = RuleAllowlist
+		return event
+	}
+
+	if oldOk && newOk {
+		oldLocation, newLocation := p.locate(oldAddr), p.locate(newAddr)
+		event.OldASN, event.NewASN = oldLocation.asn, newLocation.asn
+		event.OldCountry, event.NewCountry = oldLocation.country, newLocation.country
+	}
+
+	if oldOk && newOk && p.sameSubnet(oldAddr, newAddr) {
+		event.Rule = RuleSubnet
+	} else {
+		event.Action, event.Rule = p.cfg.Action, RuleIPChange
+	}
+	if event.OldASN != 0 && event.NewASN != 0 && event.OldASN != event.NewASN {
+		escalate(&event, or(p.cfg.ASNChangeAction, p.cfg.Action), RuleASNChange)
+	}
+	if event.OldCountry != "" && event.NewCountry != "" && event.OldCountry != event.NewCountry {
+		escalate(&event, or(p.cfg.CountryChangeAction, p.cfg.Action), RuleCountryChange)
+	}
+	return event
+}
+
+// isAllowed reports whether addr belongs to an allow-listed network
+func (p *Policy) isAllowed(addr netip.Addr) bool {
+	for _, prefix := range p.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameSubnet reports whether both addresses are of the same family and within the tolerated subnet
+func (p *Policy) sameSubnet(a, b netip.Addr) bool {
+	if a.Is4() != b.Is4() {
+		return false
+	}
+	bits := p.cfg.IPv6Prefix
+	if a.Is4() {
+		bits = p.cfg.IPv4Prefix
+	}
+	if bits == 0 {
+		return false
+	}
+	prefix, err := a.Prefix(bits)
+	return err == nil && prefix.Contains(b)
+}
+
+// lookup reads ASN and country of addr from GeoIP databases. Lookup errors leave fields empty
+func (p *Policy) lookup(addr netip.Addr) location {
+	var loc location
+	if p.asnReader != nil {
+		var record struct {
+			ASN uint `maxminddb:"autonomous_system_number"`
+		}
+		if err := p.asnReader.Lookup(net.IP(addr.AsSlice()), &record); err == nil {
+			loc.asn = record.ASN
+		}
+	}
+	if p.countryReader != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := p.countryReader.Lookup(net.IP(addr.AsSlice()), &record); err == nil {
+			loc.country = record.Country.ISOCode
+		}
+	}
+	return loc
+}
+
+// escalate replaces action of event if the given one is more severe
+func escalate(event *models.IPChangeEvent, action, rule string) {
+	if severity[action] > severity[event.Action] {
+		event.Action, event.Rule = action, rule
+	}
+}
+
+// or returns value or fallback if value is empty
+func or(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// parseAddr parses ip with optional port
+func parseAddr(ip string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
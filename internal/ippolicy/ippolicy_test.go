@@ -0,0 +1,78 @@
+package ippolicy
+
+import (
+	"net/netip"
+	"restAuthPart/internal/models"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	// Arrange
+	policy, err := New(&Config{
+		Action:              models.IPChangeWarn,
+		IPv4Prefix:          24,
+		IPv6Prefix:          64,
+		AllowedNetworks:     []string{"10.0.0.0/8"},
+		CountryChangeAction: models.IPChangeBlock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations := map[string]location{
+		"198.51.100.1": {asn: 64500, country: "DE"},
+		"198.51.100.2": {asn: 64501, country: "DE"},
+		"203.0.113.1":  {asn: 64500, country: "NL"},
+	}
+	policy.locate = func(addr netip.Addr) location {
+		return locations[addr.String()]
+	}
+
+	tests := []struct {
+		name       string
+		oldIp      string
+		newIp      string
+		wantAction string
+		wantRule   string
+	}{
+		{"Same ip", "198.51.100.1", "198.51.100.1", models.IPChangeAllow, RuleSame},
+		{"Legacy ip with port", "198.51.100.1:5555", "198.51.100.1", models.IPChangeAllow, RuleSame},
+		{"Allow-listed network", "198.51.100.1", "10.1.2.3", models.IPChangeAllow, RuleAllowlist},
+		{"Same IPv4 subnet", "192.0.2.1", "192.0.2.200", models.IPChangeAllow, RuleSubnet},
+		{"Same IPv6 subnet", "2001:db8::1", "2001:db8::ffff:1", models.IPChangeAllow, RuleSubnet},
+		{"Another IPv6 subnet", "2001:db8::1", "2001:db8:0:1::1", models.IPChangeWarn, RuleIPChange},
+		{"ASN change within subnet", "198.51.100.1", "198.51.100.2", models.IPChangeWarn, RuleASNChange},
+		{"Country change", "198.51.100.1", "203.0.113.1", models.IPChangeBlock, RuleCountryChange},
+		{"Address family change", "192.0.2.1", "2001:db8::1", models.IPChangeWarn, RuleIPChange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			event := policy.Evaluate(tt.oldIp, tt.newIp)
+
+			// Assert
+			if event.Action != tt.wantAction || event.Rule != tt.wantRule {
+				t.Errorf("policy returned wrong decision: got %v by %v want %v by %v",
+					event.Action, event.Rule, tt.wantAction, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	configs := map[string]Config{
+		"Unknown action":     {Action: "ignore"},
+		"Invalid network":    {Action: models.IPChangeWarn, AllowedNetworks: []string{"10.0.0.0/33"}},
+		"Invalid prefix":     {Action: models.IPChangeWarn, IPv4Prefix: 40},
+		"Missing GeoIP db":   {Action: models.IPChangeWarn, ASNDatabase: "missing.mmdb"},
+		"Unknown ASN action": {Action: models.IPChangeWarn, ASNChangeAction: "deny"},
+	}
+
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(&cfg); err == nil {
+				t.Errorf("New accepted invalid config %+v", cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Config ...
+type Config struct {
+	// Interval between cleanups. Zero disables cleanup, negative one is invalid
+	Interval time.Duration `yaml:"interval" env:"INTERVAL" env-default:"1h"`
+	// Retention is how long revoked and expired rows are kept after they stopped being valid
+	Retention time.Duration `yaml:"retention" env:"RETENTION" env-default:"168h"`
+	// BatchSize limits rows deleted by one statement so tables aren't locked for long
+	BatchSize int `yaml:"batchSize" env:"BATCH_SIZE" env-default:"1000"`
+}
+
+type IDatabase interface {
+	DeleteStaleTokens(ctx context.Context, expiredBefore, revokedBefore time.Time, limit int) (int, error)
+	DeleteStaleFamilies(ctx context.Context, createdBefore time.Time, limit int) (int, error)
+	DeleteExpiredDeniedTokens(ctx context.Context, expiredBefore time.Time, limit int) (int, error)
+}
+
+type IJWTManager interface {
+	RefreshTTL() time.Duration
+}
+
+// Janitor periodically deletes refresh tokens which can't be used anymore
+type Janitor struct {
+	cfg        *Config
+	db         IDatabase
+	jwtManager IJWTManager
+}
+
+// New ...
+func New(cfg *Config, db IDatabase, manager IJWTManager) (*Janitor, error) {
+	if cfg.Interval < 0 {
+		return nil, fmt.Errorf("invalid cleanup interval: %v", cfg.Interval)
+	}
+	if cfg.Retention < 0 {
+		return nil, fmt.Errorf("invalid retention: %v", cfg.Retention)
+	}
+	if cfg.BatchSize <= 0 {
+		return nil, fmt.Errorf("invalid batch size: %d", cfg.BatchSize)
+	}
+
+	return &Janitor{
+		cfg:        cfg,
+		db:         db,
+		jwtManager: manager,
+	}, nil
+}
+
+// Run cleans up every Config.Interval until ctx is done
+func (j *Janitor) Run(ctx context.Context) {
+	logger := slog.With(slog.String("module", "Janitor.Run"))
+	if j.cfg.Interval <= 0 {
+		logger.Info("Janitor disabled")
+		return
+	}
+
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Janitor stopped")
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		deleted, err := j.Clean(ctx)
+		if err != nil {
+			logger.Error("Cleanup failed", slog.Int("deleted", deleted), slog.String("err", err.Error()))
+			continue
+		}
+		logger.Info("Cleanup finished", slog.Int("deleted", deleted), slog.Duration("took", time.Since(start)))
+	}
+}
+
+// Clean deletes tokens expired or revoked more than Config.Retention ago, token families
+// left without tokens and expired denied access tokens. Returns number of deleted rows
+func (j *Janitor) Clean(ctx context.Context) (int, error) {
+	now := time.Now()
+	// Token can't outlive RefreshTTL counted from its creation
+	expiredBefore := now.Add(-j.jwtManager.RefreshTTL() - j.cfg.Retention)
+	revokedBefore := now.Add(-j.cfg.Retention)
+
+	total := 0
+	for _, del := range []func(limit int) (int, error){
+		func(limit int) (int, error) {
+			return j.db.DeleteStaleTokens(ctx, expiredBefore, revokedBefore, limit)
+		},
+		func(limit int) (int, error) {
+			return j.db.DeleteStaleFamilies(ctx, expiredBefore, limit)
+		},
+		func(limit int) (int, error) {
+			return j.db.DeleteExpiredDeniedTokens(ctx, now, limit)
+		},
+	} {
+		deleted, err := j.deleteInBatches(ctx, del)
+		total += deleted
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// deleteInBatches calls del until it deletes less than Config.BatchSize rows
+func (j *Janitor) deleteInBatches(ctx context.Context, del func(limit int) (int, error)) (int, error) {
+	total := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		deleted, err := del(j.cfg.BatchSize)
+		total += deleted
+		if err != nil || deleted == 0 || deleted < j.cfg.BatchSize {
+			return total, err
+		}
+	}
+}
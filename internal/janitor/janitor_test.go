@@ -0,0 +1,78 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"restAuthPart/internal/db"
+	"restAuthPart/internal/models"
+	"testing"
+	"time"
+)
+
+type ttl time.Duration
+
+func (t ttl) RefreshTTL() time.Duration {
+	return time.Duration(t)
+}
+
+func TestClean(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	storage := db.NewMemory()
+	guid := uuid.New()
+	if err := storage.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		familyId, err := storage.AddTokenFamily(ctx, guid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.AddRefreshToken(ctx, models.RefreshToken{UserId: guid, FamilyId: familyId, Token: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Family without tokens
+	if _, err := storage.AddTokenFamily(ctx, guid); err != nil {
+		t.Fatal(err)
+	}
+
+	// Negative TTL makes every token expired
+	janitor, err := New(&Config{BatchSize: 2}, storage, ttl(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	deleted, err := janitor.Clean(ctx)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 5 tokens and 6 families
+	if deleted != 11 {
+		t.Errorf("Clean returned wrong number of deleted rows: got %v want %v", deleted, 11)
+	}
+	if sessions, _ := storage.GetSessions(ctx, guid, time.Time{}); len(sessions) != 0 {
+		t.Errorf("Clean kept sessions: got %+v", sessions)
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	configs := map[string]Config{
+		"Zero batch size":     {Interval: time.Hour},
+		"Negative batch size": {Interval: time.Hour, BatchSize: -1},
+		"Negative interval":   {Interval: -time.Hour, BatchSize: 1000},
+		"Negative retention":  {Interval: time.Hour, Retention: -time.Hour, BatchSize: 1000},
+	}
+
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(&cfg, db.NewMemory(), ttl(time.Hour)); err == nil {
+				t.Errorf("New accepted invalid config %+v", cfg)
+			}
+		})
+	}
+}
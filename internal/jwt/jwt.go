@@ -1,91 +1,340 @@
 package jwt
 
 import (
-	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"restAuthPart/internal/models"
+	"slices"
+	"sort"
+	"sync"
 	"time"
 )
 
+// minPepperLength is the minimal length of Config.Pepper
+const minPepperLength = 32
+
 // Config ...
 type Config struct {
-	Key string `yaml:"key" env:"KEY" env-default:"secretkey"`
+	Key            string      `yaml:"key" env:"KEY" env-default:"secretkey"`
+	Algorithm      string      `yaml:"algorithm" env:"ALGORITHM" env-default:"HS512"`
+	PrivateKeyPath string      `yaml:"privateKeyPath" env:"PRIVATE_KEY_PATH"`
+	KeyID          string      `yaml:"keyId" env:"KEY_ID"`
+	Keys           []KeyConfig `yaml:"keys"`
+	ActiveKeyID    string      `yaml:"activeKeyId" env:"ACTIVE_KEY_ID"`
+	// Pepper keys HMAC of stored refresh tokens, at least minPepperLength bytes
+	Pepper string `yaml:"pepper" env:"PEPPER"`
+	// Issuer and Audience are put into issued tokens and checked by GetClaims when set.
+	// Token is accepted if its aud contains any of Audience
+	Issuer   string        `yaml:"issuer" env:"ISSUER"`
+	Audience []string      `yaml:"audience" env:"AUDIENCE"`
+	Leeway   time.Duration `yaml:"leeway" env:"LEEWAY" env-default:"30s"`
+	// Tokens lifetimes. Tokens never outlive MaxSessionLifetime counted from the login,
+	// so rotation can't extend a session. Zero MaxSessionLifetime means no limit
+	AccessTTL          time.Duration `yaml:"accessTTL" env:"ACCESS_TTL" env-default:"15m"`
+	RefreshTTL         time.Duration `yaml:"refreshTTL" env:"REFRESH_TTL" env-default:"720h"`
+	MaxSessionLifetime time.Duration `yaml:"maxSessionLifetime" env:"MAX_SESSION_LIFETIME" env-default:"0"`
 }
 
 // Manager ...
 type Manager struct {
+	mu     sync.RWMutex
 	cfg    *Config
-	method jwt.SigningMethod
+	active *signingKey
+	keys   map[string]*signingKey
+	pepper []byte
 }
 
 // New ...
-func New(cfg *Config, method jwt.SigningMethod) *Manager {
+func New(cfg *Config) (*Manager, error) {
+	if len(cfg.Pepper) < minPepperLength {
+		return nil, fmt.Errorf("pepper must be at least %d bytes", minPepperLength)
+	}
+	keys, active, err := loadKeyring(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Manager{
 		cfg:    cfg,
-		method: method,
+		active: active,
+		keys:   keys,
+		pepper: []byte(cfg.Pepper),
+	}, nil
+}
+
+// Reload replaces keyring with keys from cfg. Keys missing in cfg are kept
+// for verification only and dropped once tokens signed with them have expired.
+// Pepper isn't reloaded because stored hashes depend on it
+func (m *Manager) Reload(cfg *Config) error {
+	keys, active, err := loadKeyring(cfg)
+	if err != nil {
+		return err
 	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, key := range m.keys {
+		if _, ok := keys[id]; ok {
+			continue
+		}
+		if key.retiredAt.IsZero() {
+			key.retiredAt = now
+		}
+		if !key.expired(now, maxTokenTTL(m.cfg)) {
+			keys[id] = key
+		}
+	}
+
+	m.cfg = cfg
+	m.active = active
+	m.keys = keys
+	return nil
 }
 
-// GenerateRefreshToken generates refresh token
-func (m *Manager) GenerateRefreshToken(guid uuid.UUID, ip string) (string, error) {
-	jwtClaims := models.RefreshTokenClaims{
-		Guid: guid,
-		Ip:   ip,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * 24 * time.Hour)),
-		},
+// verificationKey returns the key with id kid if it is still accepted
+func (m *Manager) verificationKey(kid string) (*signingKey, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.keys[kid]
+	if !ok || key.expired(time.Now(), maxTokenTTL(m.cfg)) {
+		return nil, false
 	}
+	return key, true
+}
 
-	token := jwt.NewWithClaims(
-		m.method,
-		jwtClaims,
-	)
+// sign signs claims with the active key and stamps its id into the header
+func (m *Manager) sign(claims jwt.Claims) (string, error) {
+	m.mu.RLock()
+	key := m.active
+	m.mu.RUnlock()
 
-	return token.SignedString([]byte(m.cfg.Key))
+	token := jwt.NewWithClaims(key.method, claims)
+	if key.id != "" {
+		token.Header["kid"] = key.id
+	}
+	return token.SignedString(key.signKey)
 }
 
-// GenerateAccessToken generates access token
-func (m *Manager) GenerateAccessToken(guid uuid.UUID, ip string, id int) (string, error) {
-	jwtClaims := models.AccessTokenClaims{
-		Guid:      guid,
-		Ip:        ip,
-		RefreshId: id,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
-		},
+// maxTokenTTL returns the longest token lifetime.
+// Retired keys are kept for it so that tokens signed with them stay valid until expiration
+func maxTokenTTL(cfg *Config) time.Duration {
+	return max(cfg.AccessTTL, cfg.RefreshTTL)
+}
+
+// CheckKeys returns error if there is no key to sign tokens with
+func (m *Manager) CheckKeys() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.active == nil || m.active.signKey == nil {
+		return fmt.Errorf("no active signing key")
+	}
+	return nil
+}
+
+// RefreshTTL returns lifetime of refresh tokens
+func (m *Manager) RefreshTTL() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg.RefreshTTL
+}
+
+// registeredClaims returns registered claims of token for user valid for ttl.
+// Expiration is cut to the end of the session started at sessionStart
+func (m *Manager) registeredClaims(guid uuid.UUID, ttl time.Duration, sessionStart time.Time) (jwt.RegisteredClaims, error) {
+	m.mu.RLock()
+	cfg := m.cfg
+	m.mu.RUnlock()
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	if cfg.MaxSessionLifetime > 0 {
+		sessionEnd := sessionStart.Add(cfg.MaxSessionLifetime)
+		if !sessionEnd.After(now) {
+			return jwt.RegisteredClaims{}, models.ErrSessionExpired
+		}
+		if sessionEnd.Before(expiresAt) {
+			expiresAt = sessionEnd
+		}
+	}
+
+	return jwt.RegisteredClaims{
+		Issuer:    cfg.Issuer,
+		Subject:   guid.String(),
+		Audience:  cfg.Audience,
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		NotBefore: jwt.NewNumericDate(now),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ID:        uuid.NewString(),
+	}, nil
+}
+
+// GenerateRefreshToken generates refresh token of the session started at sessionStart.
+// Returns models.ErrSessionExpired if the session has reached its maximum lifetime
+func (m *Manager) GenerateRefreshToken(guid uuid.UUID, ip string, sessionStart time.Time) (string, error) {
+	m.mu.RLock()
+	ttl := m.cfg.RefreshTTL
+	m.mu.RUnlock()
+
+	registered, err := m.registeredClaims(guid, ttl, sessionStart)
+	if err != nil {
+		return "", err
+	}
+
+	jwtClaims := models.RefreshTokenClaims{
+		Guid:             guid,
+		Ip:               ip,
+		RegisteredClaims: registered,
+	}
+
+	return m.sign(jwtClaims)
+}
+
+// GenerateAccessToken generates access token of the session started at sessionStart.
+// Returns models.ErrSessionExpired if the session has reached its maximum lifetime
+func (m *Manager) GenerateAccessToken(guid uuid.UUID, ip string, id int, sessionStart time.Time) (string, error) {
+	m.mu.RLock()
+	ttl := m.cfg.AccessTTL
+	m.mu.RUnlock()
+
+	registered, err := m.registeredClaims(guid, ttl, sessionStart)
+	if err != nil {
+		return "", err
 	}
 
-	token := jwt.NewWithClaims(
-		m.method,
-		jwtClaims,
-	)
+	jwtClaims := models.AccessTokenClaims{
+		Guid:             guid,
+		Ip:               ip,
+		RefreshId:        id,
+		RegisteredClaims: registered,
+	}
 
-	return token.SignedString([]byte(m.cfg.Key))
+	return m.sign(jwtClaims)
 }
 
-// GetClaims returns claims from token
+// GetClaims returns claims from token. Besides signature and exp it checks nbf
+// and, when they are configured, iss and aud allowing Config.Leeway clock skew
 func (m *Manager) GetClaims(token string, claimsType jwt.Claims) (jwt.Claims, error) {
+	return m.getClaims(token, claimsType, false)
+}
+
+// GetClaimsIgnoringExpiry checks token like GetClaims except exp, expiry is reported instead.
+// Access token presented on refresh has usually expired already
+func (m *Manager) GetClaimsIgnoringExpiry(token string, claimsType jwt.Claims) (_ jwt.Claims, expired bool, err error) {
+	claims, err := m.getClaims(token, claimsType, true)
+	if err != nil {
+		return nil, false, err
+	}
+
+	m.mu.RLock()
+	leeway := m.cfg.Leeway
+	m.mu.RUnlock()
+
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return nil, false, err
+	}
+	return claims, exp != nil && !time.Now().Before(exp.Add(leeway)), nil
+}
+
+// withoutExpiry hides exp of claims from jwt.Validator
+type withoutExpiry struct {
+	jwt.Claims
+}
+
+func (withoutExpiry) GetExpirationTime() (*jwt.NumericDate, error) {
+	return nil, nil
+}
+
+// getClaims parses and checks token, exp is skipped if ignoreExpiry is set
+func (m *Manager) getClaims(token string, claimsType jwt.Claims, ignoreExpiry bool) (jwt.Claims, error) {
+	m.mu.RLock()
+	cfg := m.cfg
+	m.mu.RUnlock()
+
+	options := []jwt.ParserOption{jwt.WithLeeway(cfg.Leeway)}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	parserOptions := options
+	if ignoreExpiry {
+		// Claims are validated below without exp
+		parserOptions = append(slices.Clip(options), jwt.WithoutClaimsValidation())
+	}
+
 	parsedToken, err := jwt.ParseWithClaims(token, claimsType, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := m.verificationKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown key id: %q", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(m.cfg.Key), nil
-	})
+		return key.verifyKey, nil
+	}, parserOptions...)
 	if err != nil {
 		return nil, err
 	}
 
-	if parsedToken.Valid {
-		return parsedToken.Claims, nil
-	} else {
+	if !parsedToken.Valid {
 		return nil, fmt.Errorf("invalid token")
 	}
+
+	if ignoreExpiry {
+		if err := jwt.NewValidator(options...).Validate(withoutExpiry{parsedToken.Claims}); err != nil {
+			return nil, fmt.Errorf("%w: %w", jwt.ErrTokenInvalidClaims, err)
+		}
+	}
+
+	if len(cfg.Audience) > 0 {
+		audience, err := parsedToken.Claims.GetAudience()
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(audience, func(aud string) bool { return slices.Contains(cfg.Audience, aud) }) {
+			return nil, fmt.Errorf("%w: %v", jwt.ErrTokenInvalidAudience, audience)
+		}
+	}
+
+	return parsedToken.Claims, nil
+}
+
+// JWKS returns public keys of the keyring including retired ones
+// which are still accepted. HMAC keys are never published
+func (m *Manager) JWKS() models.JWKSet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	set := models.JWKSet{Keys: []models.JWK{}}
+	now := time.Now()
+	for _, key := range m.keys {
+		if key.expired(now, maxTokenTTL(m.cfg)) {
+			continue
+		}
+		if jwk, ok := toJWK(key.verifyKey, key.method.Alg(), key.id); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// HashToken returns HMAC-SHA256 of token keyed with pepper.
+// Only hashes of refresh tokens are stored, so leaked rows can't be used as tokens
+func (m *Manager) HashToken(token string) []byte {
+	mac := hmac.New(sha256.New, m.pepper)
+	mac.Write([]byte(token))
+	return mac.Sum(nil)
 }
 
-// CompareTokens compares token and hashed token
+// CompareTokens compares token and hashed token in constant time
 func (m *Manager) CompareTokens(token string, hashedToken []byte) bool {
-	//return bcrypt.CompareHashAndPassword(hashedToken, []byte(token)) == nil
-	return bytes.Compare(hashedToken, []byte(token)) == 0
+	return hmac.Equal(m.HashToken(token), hashedToken)
 }
@@ -0,0 +1,345 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	jwtlib "github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"restAuthPart/internal/models"
+	"testing"
+	"time"
+)
+
+// writeKey writes PKCS8 PEM encoded key to temporary directory and returns its path
+func writeKey(t *testing.T, key crypto.PrivateKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// pepper is a pepper of minimal length
+const pepper = "0123456789abcdef0123456789abcdef"
+
+// withTTL sets default tokens lifetimes and pepper to cfg
+func withTTL(cfg Config) *Config {
+	cfg.Pepper = pepper
+	cfg.AccessTTL = 15 * time.Minute
+	cfg.RefreshTTL = 30 * 24 * time.Hour
+	return &cfg
+}
+
+func TestManagerAlgorithms(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		kty  string
+	}{
+		{name: "HS512", cfg: Config{Algorithm: "HS512", Key: "secret"}},
+		{name: "RS256", cfg: Config{Algorithm: "RS256", PrivateKeyPath: writeKey(t, rsaKey)}, kty: "RSA"},
+		{name: "ES256", cfg: Config{Algorithm: "ES256", PrivateKeyPath: writeKey(t, ecKey), KeyID: "ec"}, kty: "EC"},
+		{name: "EdDSA", cfg: Config{Algorithm: "EdDSA", PrivateKeyPath: writeKey(t, edKey)}, kty: "OKP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(withTTL(tt.cfg))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			guid := uuid.New()
+			token, err := m.GenerateAccessToken(guid, "127.0.0.1", 1, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := m.GetClaims(token, &models.AccessTokenClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := claims.(*models.AccessTokenClaims).Guid; got != guid {
+				t.Errorf("wrong guid in claims: got %v want %v", got, guid)
+			}
+
+			keys := m.JWKS().Keys
+			if tt.kty == "" {
+				if len(keys) != 0 {
+					t.Errorf("symmetric key must not be published, got %v", keys)
+				}
+				return
+			}
+			if len(keys) != 1 || keys[0].Kty != tt.kty || keys[0].Alg != tt.name || keys[0].Kid == "" {
+				t.Errorf("unexpected JWKS: %+v", keys)
+			}
+			if tt.cfg.KeyID != "" && keys[0].Kid != tt.cfg.KeyID {
+				t.Errorf("wrong kid: got %v want %v", keys[0].Kid, tt.cfg.KeyID)
+			}
+		})
+	}
+}
+
+func TestGetClaimsRejectsOtherAlgorithm(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer, err := New(withTTL(Config{Algorithm: "ES256", PrivateKeyPath: writeKey(t, ecKey)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := New(withTTL(Config{Algorithm: "HS512", Key: "secret"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := signer.GenerateRefreshToken(uuid.New(), "127.0.0.1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.GetClaims(token, &models.RefreshTokenClaims{}); err == nil {
+		t.Error("token signed with ES256 was accepted by HS512 manager")
+	}
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	for name, cfg := range map[string]Config{
+		"unknown algorithm": {Algorithm: "XX256", Key: "secret", Pepper: pepper},
+		"none algorithm":    {Algorithm: "none", Pepper: pepper},
+		"empty secret":      {Algorithm: "HS256", Pepper: pepper},
+		"missing key":       {Algorithm: "RS256", Pepper: pepper},
+		"wrong curve":       {Algorithm: "ES256", PrivateKeyPath: writeKey(t, ecKey), Pepper: pepper},
+		"missing pepper":    {Algorithm: "HS256", Key: "secret"},
+		"short pepper":      {Algorithm: "HS256", Key: "secret", Pepper: pepper[1:]},
+	} {
+		if _, err := New(&cfg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestReloadRotatesKeys(t *testing.T) {
+	m, err := New(withTTL(Config{
+		Keys:        []KeyConfig{{ID: "old", Algorithm: "HS512", Secret: "old secret"}},
+		ActiveKeyID: "old",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _ := m.GenerateAccessToken(uuid.New(), "127.0.0.1", 1, time.Now())
+
+	err = m.Reload(withTTL(Config{
+		Keys:        []KeyConfig{{ID: "new", Algorithm: "HS512", Secret: "new secret"}},
+		ActiveKeyID: "new",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, _ := m.GenerateAccessToken(uuid.New(), "127.0.0.1", 1, time.Now())
+
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := m.GetClaims(token, &models.AccessTokenClaims{}); err != nil {
+			t.Errorf("%s token rejected: %v", name, err)
+		}
+	}
+
+	// Retired key is dropped once the longest token TTL has passed
+	m.keys["old"].retiredAt = time.Now().Add(-maxTokenTTL(m.cfg) - time.Minute)
+	if _, err := m.GetClaims(oldToken, &models.AccessTokenClaims{}); err == nil {
+		t.Error("token signed with expired retired key was accepted")
+	}
+	if err := m.Reload(withTTL(Config{Keys: []KeyConfig{{ID: "new", Algorithm: "HS512", Secret: "new secret"}}})); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.keys["old"]; ok {
+		t.Error("expired retired key wasn't dropped on reload")
+	}
+}
+
+func TestKeyringValidatesActiveKey(t *testing.T) {
+	_, err := New(&Config{
+		Keys:        []KeyConfig{{ID: "a", Algorithm: "HS512", Secret: "secret"}},
+		ActiveKeyID: "b",
+		Pepper:      pepper,
+	})
+	if err == nil {
+		t.Error("expected error for unknown active key")
+	}
+
+	_, err = New(&Config{
+		Keys: []KeyConfig{
+			{ID: "a", Algorithm: "HS512", Secret: "secret"},
+			{ID: "a", Algorithm: "HS256", Secret: "secret"},
+		},
+		Pepper: pepper,
+	})
+	if err == nil {
+		t.Error("expected error for duplicate key id")
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	m, err := New(&Config{Algorithm: "HS512", Key: "secret", Pepper: pepper})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(&Config{Algorithm: "HS512", Key: "secret", Pepper: "other " + pepper})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := m.HashToken("token")
+	if len(hash) != sha256.Size {
+		t.Errorf("wrong hash length: got %v want %v", len(hash), sha256.Size)
+	}
+	if !m.CompareTokens("token", hash) {
+		t.Error("token doesn't match its hash")
+	}
+	if m.CompareTokens("another token", hash) {
+		t.Error("another token matches the hash")
+	}
+	if m.CompareTokens("token", []byte("token")) {
+		t.Error("plaintext token matches itself")
+	}
+	if other.CompareTokens("token", hash) {
+		t.Error("hash matches with another pepper")
+	}
+}
+
+func TestRegisteredClaims(t *testing.T) {
+	cfg := Config{
+		Algorithm: "HS512",
+		Key:       "secret",
+		Issuer:    "auth",
+		Audience:  []string{"api", "admin"},
+		Leeway:    time.Minute,
+	}
+	m, err := New(withTTL(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guid := uuid.New()
+	token, _ := m.GenerateRefreshToken(guid, "127.0.0.1", time.Now())
+	claims, err := m.GetClaims(token, &models.RefreshTokenClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := claims.(*models.RefreshTokenClaims).RegisteredClaims
+	if registered.Issuer != "auth" || registered.Subject != guid.String() || len(registered.Audience) != 2 ||
+		registered.ID == "" || registered.IssuedAt == nil || registered.NotBefore == nil {
+		t.Errorf("unexpected registered claims: %+v", registered)
+	}
+
+	sign := func(claims jwtlib.RegisteredClaims) string {
+		token, err := m.sign(&models.AccessTokenClaims{Guid: guid, RefreshId: 1, RegisteredClaims: claims})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	exp := jwtlib.NewNumericDate(time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name    string
+		claims  jwtlib.RegisteredClaims
+		valid   bool
+		expired bool
+	}{
+		{name: "valid", claims: jwtlib.RegisteredClaims{Issuer: "auth", Audience: []string{"admin"}, ExpiresAt: exp}, valid: true},
+		{name: "other issuer", claims: jwtlib.RegisteredClaims{Issuer: "other", Audience: []string{"api"}, ExpiresAt: exp}},
+		{name: "other audience", claims: jwtlib.RegisteredClaims{Issuer: "auth", Audience: []string{"other"}, ExpiresAt: exp}},
+		{name: "no audience", claims: jwtlib.RegisteredClaims{Issuer: "auth", ExpiresAt: exp}},
+		{
+			name: "nbf within leeway",
+			claims: jwtlib.RegisteredClaims{Issuer: "auth", Audience: []string{"api"}, ExpiresAt: exp,
+				NotBefore: jwtlib.NewNumericDate(time.Now().Add(30 * time.Second))},
+			valid: true,
+		},
+		{
+			name: "nbf in future",
+			claims: jwtlib.RegisteredClaims{Issuer: "auth", Audience: []string{"api"}, ExpiresAt: exp,
+				NotBefore: jwtlib.NewNumericDate(time.Now().Add(time.Hour))},
+		},
+		{
+			name: "expired",
+			claims: jwtlib.RegisteredClaims{Issuer: "auth", Audience: []string{"api"},
+				ExpiresAt: jwtlib.NewNumericDate(time.Now().Add(-time.Hour))},
+			expired: true,
+		},
+		{
+			name: "expired of other issuer",
+			claims: jwtlib.RegisteredClaims{Issuer: "other", Audience: []string{"api"},
+				ExpiresAt: jwtlib.NewNumericDate(time.Now().Add(-time.Hour))},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := sign(tt.claims)
+			_, err := m.GetClaims(token, &models.AccessTokenClaims{})
+			if tt.valid && err != nil {
+				t.Errorf("valid token rejected: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("invalid token accepted")
+			}
+
+			// Expired token is accepted only when expiry is ignored
+			_, expired, err := m.GetClaimsIgnoringExpiry(token, &models.AccessTokenClaims{})
+			if (tt.valid || tt.expired) != (err == nil) || expired != tt.expired {
+				t.Errorf("GetClaimsIgnoringExpiry returned wrong result: got %v, %v want expired %v", expired, err, tt.expired)
+			}
+		})
+	}
+}
+
+func TestSessionLifetime(t *testing.T) {
+	cfg := withTTL(Config{Algorithm: "HS512", Key: "secret"})
+	cfg.MaxSessionLifetime = time.Hour
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Refresh token of the session started 50 minutes ago expires with the session
+	sessionStart := time.Now().Add(-50 * time.Minute)
+	token, err := m.GenerateRefreshToken(uuid.New(), "127.0.0.1", sessionStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := m.GetClaims(token, &models.RefreshTokenClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sessionStart.Add(time.Hour).Truncate(time.Second)
+	if exp := claims.(*models.RefreshTokenClaims).ExpiresAt.Time; !exp.Equal(expected) {
+		t.Errorf("wrong expiration: got %v want %v", exp, expected)
+	}
+
+	// Tokens of expired session aren't issued
+	_, err = m.GenerateAccessToken(uuid.New(), "127.0.0.1", 1, time.Now().Add(-2*time.Hour))
+	if !errors.Is(err, models.ErrSessionExpired) {
+		t.Errorf("unexpected error: got %v want %v", err, models.ErrSessionExpired)
+	}
+}
@@ -0,0 +1,98 @@
+package jwt
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"time"
+)
+
+// KeyConfig describes one key of the keyring
+type KeyConfig struct {
+	ID             string `yaml:"id"`
+	Algorithm      string `yaml:"algorithm"`
+	Secret         string `yaml:"secret"`
+	PrivateKeyPath string `yaml:"privateKeyPath"`
+}
+
+// signingKey is a loaded key of the keyring.
+// retiredAt is zero while the key is present in config
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   crypto.PrivateKey
+	verifyKey crypto.PublicKey
+	retiredAt time.Time
+}
+
+// expired reports whether every token signed with retired key has already expired
+func (k *signingKey) expired(now time.Time, maxTokenTTL time.Duration) bool {
+	return !k.retiredAt.IsZero() && now.Sub(k.retiredAt) > maxTokenTTL
+}
+
+// keyConfigs returns keys from cfg. Single key from Key, Algorithm,
+// PrivateKeyPath and KeyID fields is used when Keys list is empty
+func keyConfigs(cfg *Config) []KeyConfig {
+	if len(cfg.Keys) > 0 {
+		return cfg.Keys
+	}
+	return []KeyConfig{{
+		ID:             cfg.KeyID,
+		Algorithm:      cfg.Algorithm,
+		Secret:         cfg.Key,
+		PrivateKeyPath: cfg.PrivateKeyPath,
+	}}
+}
+
+// loadKey loads the key described by kc
+func loadKey(kc KeyConfig) (*signingKey, error) {
+	method := jwt.GetSigningMethod(kc.Algorithm)
+	if method == nil || method == jwt.SigningMethodNone {
+		return nil, fmt.Errorf("unknown signing algorithm: %s", kc.Algorithm)
+	}
+
+	signKey, verifyKey, err := loadKeys(method, kc.Secret, kc.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", kc.ID, err)
+	}
+
+	id := kc.ID
+	if _, ok := method.(*jwt.SigningMethodHMAC); !ok && id == "" {
+		if id, err = keyID(verifyKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &signingKey{
+		id:        id,
+		method:    method,
+		signKey:   signKey,
+		verifyKey: verifyKey,
+	}, nil
+}
+
+// loadKeyring loads all keys from cfg and returns them with the active one
+func loadKeyring(cfg *Config) (map[string]*signingKey, *signingKey, error) {
+	keys := make(map[string]*signingKey)
+	var active *signingKey
+
+	for _, kc := range keyConfigs(cfg) {
+		key, err := loadKey(kc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := keys[key.id]; ok {
+			return nil, nil, fmt.Errorf("duplicate key id %q", key.id)
+		}
+		keys[key.id] = key
+
+		if active == nil && (cfg.ActiveKeyID == "" || cfg.ActiveKeyID == key.id) {
+			active = key
+		}
+	}
+
+	if active == nil {
+		return nil, nil, fmt.Errorf("active key %q not found", cfg.ActiveKeyID)
+	}
+	return keys, active, nil
+}
@@ -0,0 +1,111 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"os"
+	"restAuthPart/internal/models"
+)
+
+// loadKeys returns signing and verification keys for method.
+// HMAC methods use the shared secret, others read the private key from PEM file
+func loadKeys(method jwt.SigningMethod, secret, privateKeyPath string) (crypto.PrivateKey, crypto.PublicKey, error) {
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		if secret == "" {
+			return nil, nil, fmt.Errorf("empty secret for %s", method.Alg())
+		}
+		return []byte(secret), []byte(secret), nil
+	}
+
+	if privateKeyPath == "" {
+		return nil, nil, fmt.Errorf("private key path is required for %s", method.Alg())
+	}
+	data, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	case *jwt.SigningMethodECDSA:
+		key, err := jwt.ParseECPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key.Curve.Params().BitSize != method.(*jwt.SigningMethodECDSA).CurveBits {
+			return nil, nil, fmt.Errorf("curve %s doesn't match %s", key.Curve.Params().Name, method.Alg())
+		}
+		return key, &key.PublicKey, nil
+	case *jwt.SigningMethodEd25519:
+		key, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, key.(ed25519.PrivateKey).Public(), nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported signing method: %s", method.Alg())
+	}
+}
+
+// keyID returns the first 16 characters of base64url encoded SHA-256 of the public key.
+// Used when key id isn't set in config
+func keyID(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:])[:16], nil
+}
+
+// toJWK converts public key to models.JWK. ok is false for symmetric keys,
+// they must never be published
+func toJWK(publicKey crypto.PublicKey, alg, kid string) (models.JWK, bool) {
+	jwk := models.JWK{
+		Use: "sig",
+		Alg: alg,
+		Kid: kid,
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(bigEndian(key.E))
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = key.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+	default:
+		return models.JWK{}, false
+	}
+
+	return jwk, true
+}
+
+// bigEndian returns minimal big-endian representation of n
+func bigEndian(n int) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"restAuthPart/internal/janitor"
+	"restAuthPart/internal/models"
+	"restAuthPart/internal/service"
+	"time"
+)
+
+// IDatabase is the storage wrapped by Database
+type IDatabase interface {
+	service.IDatabase
+	janitor.IDatabase
+	RehashLegacyTokens(ctx context.Context, hash func(token string) []byte) (int, error)
+	CountActiveSessions(ctx context.Context, createdAfter time.Time) (int, error)
+	Close()
+}
+
+// Database observes duration of every operation of the wrapped storage
+type Database struct {
+	db      IDatabase
+	metrics *Metrics
+}
+
+// NewDatabase ...
+func NewDatabase(db IDatabase, metrics *Metrics) *Database {
+	return &Database{
+		db:      db,
+		metrics: metrics,
+	}
+}
+
+// Close ...
+func (d *Database) Close() {
+	d.db.Close()
+}
+
+// Ping ...
+func (d *Database) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("Ping", start, err) }(time.Now())
+	return d.db.Ping(ctx)
+}
+
+// AddUserIfNotExist ...
+func (d *Database) AddUserIfNotExist(ctx context.Context, user models.User) (err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("AddUserIfNotExist", start, err) }(time.Now())
+	return d.db.AddUserIfNotExist(ctx, user)
+}
+
+// AddTokenFamily ...
+func (d *Database) AddTokenFamily(ctx context.Context, guid uuid.UUID) (_ uuid.UUID, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("AddTokenFamily", start, err) }(time.Now())
+	return d.db.AddTokenFamily(ctx, guid)
+}
+
+// AddRefreshToken ...
+func (d *Database) AddRefreshToken(ctx context.Context, token models.RefreshToken) (_ int, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("AddRefreshToken", start, err) }(time.Now())
+	return d.db.AddRefreshToken(ctx, token)
+}
+
+// GetRefreshToken ...
+func (d *Database) GetRefreshToken(ctx context.Context, refreshTokenId int) (_ models.RefreshToken, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("GetRefreshToken", start, err) }(time.Now())
+	return d.db.GetRefreshToken(ctx, refreshTokenId)
+}
+
+// GetRefreshTokenByHash ...
+func (d *Database) GetRefreshTokenByHash(ctx context.Context, tokenHash []byte) (_ models.RefreshToken, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("GetRefreshTokenByHash", start, err) }(time.Now())
+	return d.db.GetRefreshTokenByHash(ctx, tokenHash)
+}
+
+// MarkRefreshTokenUsed ...
+func (d *Database) MarkRefreshTokenUsed(ctx context.Context, refreshTokenId int, ip string) (_ bool, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("MarkRefreshTokenUsed", start, err) }(time.Now())
+	return d.db.MarkRefreshTokenUsed(ctx, refreshTokenId, ip)
+}
+
+// RevokeTokenFamily ...
+func (d *Database) RevokeTokenFamily(ctx context.Context, familyId uuid.UUID) (err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("RevokeTokenFamily", start, err) }(time.Now())
+	return d.db.RevokeTokenFamily(ctx, familyId)
+}
+
+// RevokeRefreshToken ...
+func (d *Database) RevokeRefreshToken(ctx context.Context, refreshTokenId int) (err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("RevokeRefreshToken", start, err) }(time.Now())
+	return d.db.RevokeRefreshToken(ctx, refreshTokenId)
+}
+
+// GetUser ...
+func (d *Database) GetUser(ctx context.Context, guid uuid.UUID) (_ models.User, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("GetUser", start, err) }(time.Now())
+	return d.db.GetUser(ctx, guid)
+}
+
+// RevokeUserTokens ...
+func (d *Database) RevokeUserTokens(ctx context.Context, guid uuid.UUID, revokedBefore time.Time) (err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("RevokeUserTokens", start, err) }(time.Now())
+	return d.db.RevokeUserTokens(ctx, guid, revokedBefore)
+}
+
+// DenyAccessToken ...
+func (d *Database) DenyAccessToken(ctx context.Context, jti string, expiresAt time.Time) (err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("DenyAccessToken", start, err) }(time.Now())
+	return d.db.DenyAccessToken(ctx, jti, expiresAt)
+}
+
+// IsAccessTokenDenied ...
+func (d *Database) IsAccessTokenDenied(ctx context.Context, jti string) (_ bool, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("IsAccessTokenDenied", start, err) }(time.Now())
+	return d.db.IsAccessTokenDenied(ctx, jti)
+}
+
+// GetSessions ...
+func (d *Database) GetSessions(ctx context.Context, guid uuid.UUID, createdAfter time.Time) (_ []models.Session, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("GetSessions", start, err) }(time.Now())
+	return d.db.GetSessions(ctx, guid, createdAfter)
+}
+
+// RevokeSession ...
+func (d *Database) RevokeSession(ctx context.Context, guid uuid.UUID, sessionId uuid.UUID) (_ bool, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("RevokeSession", start, err) }(time.Now())
+	return d.db.RevokeSession(ctx, guid, sessionId)
+}
+
+// AddIPChangeEvent ...
+func (d *Database) AddIPChangeEvent(ctx context.Context, event models.IPChangeEvent) (err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("AddIPChangeEvent", start, err) }(time.Now())
+	return d.db.AddIPChangeEvent(ctx, event)
+}
+
+// CountActiveSessions ...
+func (d *Database) CountActiveSessions(ctx context.Context, createdAfter time.Time) (_ int, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("CountActiveSessions", start, err) }(time.Now())
+	return d.db.CountActiveSessions(ctx, createdAfter)
+}
+
+// RehashLegacyTokens ...
+func (d *Database) RehashLegacyTokens(ctx context.Context, hash func(token string) []byte) (_ int, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("RehashLegacyTokens", start, err) }(time.Now())
+	return d.db.RehashLegacyTokens(ctx, hash)
+}
+
+// DeleteStaleTokens ...
+func (d *Database) DeleteStaleTokens(ctx context.Context, expiredBefore, revokedBefore time.Time, limit int) (_ int, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("DeleteStaleTokens", start, err) }(time.Now())
+	return d.db.DeleteStaleTokens(ctx, expiredBefore, revokedBefore, limit)
+}
+
+// DeleteStaleFamilies ...
+func (d *Database) DeleteStaleFamilies(ctx context.Context, createdBefore time.Time, limit int) (_ int, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("DeleteStaleFamilies", start, err) }(time.Now())
+	return d.db.DeleteStaleFamilies(ctx, createdBefore, limit)
+}
+
+// DeleteExpiredDeniedTokens ...
+func (d *Database) DeleteExpiredDeniedTokens(ctx context.Context, expiredBefore time.Time, limit int) (_ int, err error) {
+	defer func(start time.Time) { d.metrics.observeQuery("DeleteExpiredDeniedTokens", start, err) }(time.Now())
+	return d.db.DeleteExpiredDeniedTokens(ctx, expiredBefore, limit)
+}
@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// reasonNone is a reason of successful request
+const reasonNone = "none"
+
+// sessionsTimeout limits counting of active sessions on scrape
+const sessionsTimeout = 2 * time.Second
+
+// Metrics keeps Prometheus collectors of the server in its own registry
+type Metrics struct {
+	registry *prometheus.Registry
+
+	authRequests     *prometheus.CounterVec
+	refreshRequests  *prometheus.CounterVec
+	ipChangeWarnings prometheus.Counter
+	tokensIssued     prometheus.Counter
+	requestDuration  *prometheus.HistogramVec
+	queryDuration    *prometheus.HistogramVec
+}
+
+// New ...
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		authRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_requests_total",
+			Help: "Auth requests by outcome and reason of failure.",
+		}, []string{"outcome", "reason"}),
+		refreshRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "refresh_requests_total",
+			Help: "Refresh requests by outcome and reason of failure.",
+		}, []string{"outcome", "reason"}),
+		ipChangeWarnings: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ip_change_warnings_total",
+			Help: "Refreshes from ip other than the one the token was issued to.",
+		}),
+		tokensIssued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tokens_issued_total",
+			Help: "Issued pairs of access and refresh tokens.",
+		}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of HTTP requests by route pattern.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "db_query_duration_seconds",
+			Help:    "Duration of storage operations.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation", "outcome"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.authRequests,
+		m.refreshRequests,
+		m.ipChangeWarnings,
+		m.tokensIssued,
+		m.requestDuration,
+		m.queryDuration,
+	)
+	return m
+}
+
+// outcome returns outcome label of request failed with reason
+func outcome(reason string) string {
+	if reason == reasonNone {
+		return "success"
+	}
+	return "failure"
+}
+
+// AuthRequest counts auth request, reason is "none" for successful one
+func (m *Metrics) AuthRequest(reason string) {
+	m.authRequests.WithLabelValues(outcome(reason), reason).Inc()
+}
+
+// RefreshRequest counts refresh request, reason is "none" for successful one
+func (m *Metrics) RefreshRequest(reason string) {
+	m.refreshRequests.WithLabelValues(outcome(reason), reason).Inc()
+}
+
+// IPChangeWarning counts refresh from changed ip
+func (m *Metrics) IPChangeWarning() {
+	m.ipChangeWarnings.Inc()
+}
+
+// TokensIssued counts issued token pair
+func (m *Metrics) TokensIssued() {
+	m.tokensIssued.Inc()
+}
+
+// RegisterPool adds gauges of database connection pool read from stats on every scrape.
+// stats returns maximum, open, idle and in use connections
+func (m *Metrics) RegisterPool(stats func() (limit, open, idle, inUse int)) {
+	gauge := func(name, help string, value func(limit, open, idle, inUse int) int) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: name,
+			Help: help,
+		}, func() float64 { return float64(value(stats())) })
+	}
+
+	m.registry.MustRegister(
+		gauge("db_pool_max_connections", "Maximum connections of database pool.",
+			func(limit, _, _, _ int) int { return limit }),
+		gauge("db_pool_connections", "Open connections of database pool.",
+			func(_, open, _, _ int) int { return open }),
+		gauge("db_pool_idle_connections", "Idle connections of database pool.",
+			func(_, _, idle, _ int) int { return idle }),
+		gauge("db_pool_in_use_connections", "Connections of database pool in use.",
+			func(_, _, _, inUse int) int { return inUse }),
+	)
+}
+
+// RegisterSessions adds gauge of active sessions counted on every scrape.
+// Failed count is logged and reported as zero
+func (m *Metrics) RegisterSessions(count func(ctx context.Context) (int, error)) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "active_sessions",
+		Help: "Sessions which are neither revoked nor expired.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), sessionsTimeout)
+		defer cancel()
+
+		n, err := count(ctx)
+		if err != nil {
+			slog.Error("Cannot count active sessions", slog.String("module", "Metrics.RegisterSessions"),
+				slog.String("err", err.Error()))
+			return 0
+		}
+		return float64(n)
+	}))
+}
+
+// Middleware observes duration of requests. Route is the matched chi pattern,
+// so path parameters like guid don't blow up the number of series
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.requestDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Handler returns http.Handler exposing the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// observeQuery observes duration of storage operation started at start
+func (m *Metrics) observeQuery(operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.queryDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
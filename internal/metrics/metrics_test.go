@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	// Arrange
+	m := New()
+	r := chi.NewRouter()
+	r.Use(m.Middleware)
+	r.Get("/auth/{guid}", func(w http.ResponseWriter, r *http.Request) {
+		m.AuthRequest("bad_guid")
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	r.Method(http.MethodGet, "/metrics", m.Handler())
+
+	// Act
+	for _, guid := range []string{"a", "b"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/auth/"+guid, nil))
+	}
+	m.AuthRequest(reasonNone)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rr.Body)
+
+	// Assert
+	if got := testutil.ToFloat64(m.authRequests.WithLabelValues("failure", "bad_guid")); got != 2 {
+		t.Errorf("wrong number of failed auth requests: got %v want 2", got)
+	}
+	if got := testutil.ToFloat64(m.authRequests.WithLabelValues("success", reasonNone)); got != 1 {
+		t.Errorf("wrong number of successful auth requests: got %v want 1", got)
+	}
+	// Requests to different guids share the route pattern
+	want := `http_request_duration_seconds_count{method="GET",route="/auth/{guid}",status="400"} 2`
+	if !strings.Contains(string(body), want) {
+		t.Errorf("metrics don't contain %v", want)
+	}
+}
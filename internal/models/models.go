@@ -1,14 +1,60 @@
 package models
 
 import (
+	"context"
+	"errors"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"time"
 )
 
+// ErrNotFound is returned by storage when requested row doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate is returned by storage when a row violates a unique constraint
+var ErrDuplicate = errors.New("duplicate")
+
+// ErrSessionExpired is returned when tokens can't be issued because
+// the session has reached its maximum lifetime
+var ErrSessionExpired = errors.New("session expired")
+
+// User is a stored user. Access tokens issued before RevokedBefore are rejected
 type User struct {
-	Guid  uuid.UUID
-	Ip    string
-	Email string
+	Guid          uuid.UUID
+	Ip            string
+	Email         string
+	RevokedBefore *time.Time
+}
+
+// RefreshToken is a stored refresh token. Tokens issued by rotation
+// share FamilyId with the token they were issued for. SessionCreatedAt is
+// the creation time of the family
+type RefreshToken struct {
+	Id               int
+	UserId           uuid.UUID
+	FamilyId         uuid.UUID
+	SessionCreatedAt time.Time
+	Token            []byte
+	CreatedAt        time.Time
+	UsedAt           *time.Time
+	RevokedAt        *time.Time
+	LastUsedAt       *time.Time
+	CreatedIp        string
+	LastIp           string
+	UserAgent        string
+}
+
+// Session is a token family with metadata of its tokens.
+// CreatedIp is the IP of the login, LastIp is the IP of the last refresh
+type Session struct {
+	Id         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	CreatedIp  string     `json:"createdIp"`
+	LastIp     string     `json:"lastIp"`
+	UserAgent  string     `json:"userAgent"`
+	Current    bool       `json:"current"`
+	RefreshId  int        `json:"-"`
 }
 
 type AccessRefreshJSON struct {
@@ -33,3 +79,93 @@ type AccessTokenClaims struct {
 	RefreshId int       `json:"refreshId"`
 	jwt.RegisteredClaims
 }
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// IntrospectionJSON is the response of token introspection (RFC 7662)
+type IntrospectionJSON struct {
+	Active    bool   `json:"active"`
+	Sub       string `json:"sub,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// clientIdKey is context key of authenticated OAuth client id
+type clientIdKey struct{}
+
+// WithClientId returns ctx carrying id of OAuth client authenticated by router
+func WithClientId(ctx context.Context, clientId string) context.Context {
+	return context.WithValue(ctx, clientIdKey{}, clientId)
+}
+
+// ClientId returns id of OAuth client authenticated by router or empty string
+func ClientId(ctx context.Context) string {
+	clientId, _ := ctx.Value(clientIdKey{}).(string)
+	return clientId
+}
+
+// HealthJSON is the response of readiness check. Status is "ok" or "fail"
+type HealthJSON struct {
+	Status string               `json:"status"`
+	Checks map[string]CheckJSON `json:"checks,omitempty"`
+}
+
+// CheckJSON is the result of one dependency check
+type CheckJSON struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ProblemJSON is the error response (RFC 7807). Code is a stable machine-readable
+// error code, Detail is safe to show and never contains internal errors
+type ProblemJSON struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+// Actions of ip change policy on refresh from other ip than the token was issued to
+const (
+	IPChangeAllow  = "allow"
+	IPChangeWarn   = "warn"
+	IPChangeReauth = "reauth"
+	IPChangeBlock  = "block"
+)
+
+// IPChangeEvent is a decision of ip change policy kept in the audit trail.
+// Rule is the policy rule which decided the action. ASN and country are
+// empty if GeoIP databases aren't configured or don't know the address
+type IPChangeEvent struct {
+	Id         int       `json:"id"`
+	UserId     uuid.UUID `json:"userId"`
+	FamilyId   uuid.UUID `json:"familyId"`
+	OldIp      string    `json:"oldIp"`
+	NewIp      string    `json:"newIp"`
+	OldASN     uint      `json:"oldAsn,omitempty"`
+	NewASN     uint      `json:"newAsn,omitempty"`
+	OldCountry string    `json:"oldCountry,omitempty"`
+	NewCountry string    `json:"newCountry,omitempty"`
+	Action     string    `json:"action"`
+	Rule       string    `json:"rule"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
@@ -0,0 +1,139 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// proxyHeaders are headers a trusted proxy may put client address into
+var proxyHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"}
+
+// clientIPResolver finds address of the client behind trusted proxies
+type clientIPResolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+// newClientIPResolver parses proxies given as CIDRs or single addresses.
+// header is the one of proxyHeaders the proxies set, others are ignored
+func newClientIPResolver(proxies []string, header string) (*clientIPResolver, error) {
+	c := &clientIPResolver{}
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			c.trusted = append(c.trusted, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %q", proxy)
+		}
+		c.trusted = append(c.trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	i := slices.IndexFunc(proxyHeaders, func(h string) bool { return strings.EqualFold(h, header) })
+	if i >= 0 {
+		c.header = proxyHeaders[i]
+	} else if len(c.trusted) > 0 {
+		return nil, fmt.Errorf("unknown proxy header: %q", header)
+	}
+	return c, nil
+}
+
+// trusts reports whether addr belongs to a trusted proxy
+func (c *clientIPResolver) trusts(addr netip.Addr) bool {
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns client ip without port. Only the header set by the proxies is read and only
+// if the request came from a trusted proxy. Hops are walked from the nearest one and the first
+// untrusted address is the client, so a client can't spoof its address by sending headers.
+// Returns empty string if the client is hidden behind an obfuscated or malformed hop
+func (c *clientIPResolver) resolve(r *http.Request) string {
+	peer, ok := parseHop(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !c.trusts(peer) {
+		return peer.String()
+	}
+
+	var hops []string
+	switch c.header {
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values(c.header))
+	case "X-Forwarded-For":
+		for _, value := range r.Header.Values(c.header) {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	case "X-Real-IP":
+		if realIP := r.Header.Get(c.header); realIP != "" {
+			hops = []string{realIP}
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			// Obfuscated or malformed hop, the client is unknown
+			return ""
+		}
+		client = addr
+		if !c.trusts(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// middleware replaces RemoteAddr of request with resolved client ip
+func (c *clientIPResolver) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = c.resolve(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor returns "for" parameters of Forwarded header values (RFC 7239)
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, val)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses address with optional port, brackets and quotes
+// like 192.0.2.1, 192.0.2.1:443 or "[2001:db8::1]:443"
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+
+	addr, err := netip.ParseAddr(hop)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
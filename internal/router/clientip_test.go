@@ -0,0 +1,60 @@
+package router
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	// Arrange
+	proxies := []string{"10.0.0.0/8", "2001:db8::1"}
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"Direct client", "X-Forwarded-For", "203.0.113.7:51234", nil, "203.0.113.7"},
+		{"Untrusted peer sends headers", "X-Forwarded-For", "203.0.113.7:51234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"X-Forwarded-For", "X-Forwarded-For", "10.0.0.2:443", map[string]string{"X-Forwarded-For": "198.51.100.1:5555, 10.1.1.1"}, "198.51.100.1"},
+		{"Spoofed X-Forwarded-For", "X-Forwarded-For", "10.0.0.2:443", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"Spoofed Forwarded", "X-Forwarded-For", "10.0.0.2:443", map[string]string{"Forwarded": "for=203.0.113.9", "X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"Spoofed X-Forwarded-For behind Forwarded proxy", "Forwarded", "10.0.0.2:443", map[string]string{"Forwarded": "for=198.51.100.7", "X-Forwarded-For": "203.0.113.9"}, "198.51.100.7"},
+		{"X-Real-IP", "X-Real-IP", "10.0.0.2:443", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"Forwarded", "Forwarded", "[2001:db8::1]:443", map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.3`}, "2001:db8:cafe::17"},
+		{"Obfuscated hop", "Forwarded", "10.0.0.2:443", map[string]string{"Forwarded": "for=_hidden, for=10.0.0.3"}, ""},
+		{"Malformed X-Forwarded-For hop", "X-Forwarded-For", "10.0.0.2:443", map[string]string{"X-Forwarded-For": "198.51.100.1, unknown, 10.1.1.1"}, ""},
+		{"Obfuscated hop before untrusted one", "Forwarded", "10.0.0.2:443", map[string]string{"Forwarded": "for=_hidden, for=198.51.100.1"}, "198.51.100.1"},
+		{"IPv4-mapped peer", "x-real-ip", "[::ffff:10.0.0.2]:443", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := newClientIPResolver(proxies, tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			// Act
+			got := resolver.resolve(req)
+
+			// Assert
+			if got != tt.want {
+				t.Errorf("resolver returned wrong ip: got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownProxyHeader(t *testing.T) {
+	if _, err := newClientIPResolver([]string{"10.0.0.0/8"}, "X-Client-IP"); err == nil {
+		t.Error("resolver accepted unknown proxy header")
+	}
+}
@@ -1,46 +1,121 @@
 package router
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"net/http"
+	"restAuthPart/internal/models"
+	"slices"
 	"time"
 )
 
 type IService interface {
 	Auth() http.HandlerFunc
 	Refresh() http.HandlerFunc
+	Logout() http.HandlerFunc
+	LogoutAll() http.HandlerFunc
+	Sessions() http.HandlerFunc
+	RevokeSession() http.HandlerFunc
+	Introspect() http.HandlerFunc
+	Revoke() http.HandlerFunc
+	RevokeUser() http.HandlerFunc
+	JWKS() http.HandlerFunc
+	Healthz() http.HandlerFunc
+	Readyz() http.HandlerFunc
+}
+
+type IMetrics interface {
+	Middleware(next http.Handler) http.Handler
+	Handler() http.Handler
+}
+
+type ITracing interface {
+	Middleware(next http.Handler) http.Handler
 }
 
 // Config ...
 type Config struct {
 	Host string `yaml:"host" env:"HOST" env-default:""`
 	Port string `yaml:"port" env:"PORT" env-default:"8080"`
+	// Clients are ids and secrets of OAuth clients allowed to use /introspect and /revoke
+	Clients map[string]string `yaml:"clients" env:"CLIENTS"`
+	// TrustedProxies are CIDRs or addresses of proxies whose ProxyHeader is used to find
+	// client ip. ProxyHeader is Forwarded, X-Forwarded-For or X-Real-IP, the one the proxies set.
+	// Other headers and headers of other peers are ignored
+	TrustedProxies []string `yaml:"trustedProxies" env:"TRUSTED_PROXIES"`
+	ProxyHeader    string   `yaml:"proxyHeader" env:"PROXY_HEADER" env-default:"X-Forwarded-For"`
+	// ClientCertNames are common names of client certificates allowed to use /introspect and /revoke
+	ClientCertNames []string `yaml:"clientCertNames" env:"CLIENT_CERT_NAMES"`
+	// TLS is enabled when CertFile and KeyFile are set. Files are reloaded on SIGHUP and
+	// when they change, CertCheckInterval is how often they are checked, zero disables checks.
+	// Client certificates are verified against ClientCAFile when it is set,
+	// RequireClientCert requires ClientCAFile
+	CertFile          string        `yaml:"certFile" env:"CERT_FILE"`
+	KeyFile           string        `yaml:"keyFile" env:"KEY_FILE"`
+	MinTLSVersion     string        `yaml:"minTLSVersion" env:"MIN_TLS_VERSION" env-default:"1.2"`
+	ClientCAFile      string        `yaml:"clientCAFile" env:"CLIENT_CA_FILE"`
+	RequireClientCert bool          `yaml:"requireClientCert" env:"REQUIRE_CLIENT_CERT"`
+	CertCheckInterval time.Duration `yaml:"certCheckInterval" env:"CERT_CHECK_INTERVAL" env-default:"1m"`
+	// Server timeouts. RequestTimeout cancels context of handlers,
+	// ShutdownTimeout limits draining of in-flight requests on shutdown
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout" env:"READ_HEADER_TIMEOUT" env-default:"5s"`
+	ReadTimeout       time.Duration `yaml:"readTimeout" env:"READ_TIMEOUT" env-default:"10s"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout" env:"WRITE_TIMEOUT" env-default:"15s"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout" env:"IDLE_TIMEOUT" env-default:"60s"`
+	RequestTimeout    time.Duration `yaml:"requestTimeout" env:"REQUEST_TIMEOUT" env-default:"10s"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" env-default:"20s"`
+	// ShutdownDelay is how long the server keeps accepting connections with failing
+	// readiness before draining, so load balancers stop sending new requests
+	ShutdownDelay time.Duration `yaml:"shutdownDelay" env:"SHUTDOWN_DELAY" env-default:"5s"`
+	// /metrics is served on a separate admin listener when AdminPort is set
+	// and on the main one otherwise
+	AdminHost string `yaml:"adminHost" env:"ADMIN_HOST" env-default:""`
+	AdminPort string `yaml:"adminPort" env:"ADMIN_PORT" env-default:""`
 }
 
 // Router ...
 type Router struct {
-	cfg     *Config
-	router  *chi.Mux
-	service IService
+	cfg       *Config
+	router    *chi.Mux
+	server    *http.Server
+	admin     *http.Server
+	service   IService
+	metrics   IMetrics
+	tracing   ITracing
+	tls       *tlsReloader
+	watchCtx  context.Context
+	stopWatch context.CancelFunc
 }
 
 // New ...
-func New(cfg *Config, service IService) *Router {
+func New(cfg *Config, service IService, metrics IMetrics, tracing ITracing) (*Router, error) {
 	r := &Router{
 		cfg:     cfg,
 		router:  chi.NewRouter(),
 		service: service,
+		metrics: metrics,
+		tracing: tracing,
+	}
+	r.watchCtx, r.stopWatch = context.WithCancel(context.Background())
+
+	clientIP, err := newClientIPResolver(r.cfg.TrustedProxies, r.cfg.ProxyHeader)
+	if err != nil {
+		return nil, err
 	}
 
-	// Attach middlewares to router
+	// Attach middlewares to router. Tracing and metrics go first to observe recovered panics too.
+	// RemoteAddr is replaced with client ip without port before anything reads it
+	r.router.Use(r.tracing.Middleware)
+	r.router.Use(clientIP.middleware)
+	r.router.Use(r.metrics.Middleware)
 	r.router.Use(middleware.Recoverer)
 	r.router.Use(middleware.Logger)
 	r.router.Use(middleware.RequestID)
-	r.router.Use(middleware.AllowContentType("application/json"))
-	r.router.Use(middleware.Timeout(10 * time.Second))
+	r.router.Use(middleware.Timeout(r.cfg.RequestTimeout))
 	r.router.Use(middleware.RequestSize(5 << 20))
 	r.router.Use(cors.Handler(cors.Options{
 		AllowedOrigins: []string{"https://*", "http://*"},
@@ -52,13 +127,148 @@ func New(cfg *Config, service IService) *Router {
 		MaxAge:           300,
 	}))
 
-	r.router.Get("/auth/{guid}", r.service.Auth())
-	r.router.Post("/refresh/", r.service.Refresh())
+	// Probes of orchestrator
+	r.router.Get("/healthz", r.service.Healthz())
+	r.router.Get("/readyz", r.service.Readyz())
+	if r.cfg.AdminPort == "" {
+		r.router.Method(http.MethodGet, "/metrics", r.metrics.Handler())
+	}
+
+	r.router.Group(func(router chi.Router) {
+		router.Use(middleware.AllowContentType("application/json"))
+
+		router.Get("/auth/{guid}", r.service.Auth())
+		router.Post("/refresh/", r.service.Refresh())
+		router.Post("/logout", r.service.Logout())
+		router.Post("/logout/all", r.service.LogoutAll())
+		router.Get("/sessions", r.service.Sessions())
+		router.Delete("/sessions/{id}", r.service.RevokeSession())
+		router.Get("/.well-known/jwks.json", r.service.JWKS())
+	})
+
+	// OAuth endpoints for resource servers take form parameters and client credentials
+	r.router.Group(func(router chi.Router) {
+		router.Use(middleware.AllowContentType("application/x-www-form-urlencoded"))
+		router.Use(r.clientAuth)
 
-	return r
+		router.Post("/introspect", r.service.Introspect())
+		router.Post("/revoke", r.service.Revoke())
+		router.Post("/users/{guid}/revoke", r.service.RevokeUser())
+	})
+
+	r.server = r.newServer(r.cfg.Host, r.cfg.Port, r.router)
+	if r.cfg.AdminPort != "" {
+		admin := chi.NewRouter()
+		admin.Use(middleware.Recoverer)
+		admin.Method(http.MethodGet, "/metrics", r.metrics.Handler())
+		r.admin = r.newServer(r.cfg.AdminHost, r.cfg.AdminPort, admin)
+	}
+
+	if r.cfg.CertFile != "" || r.cfg.KeyFile != "" {
+		reloader, err := newTLSReloader(r.cfg)
+		if err != nil {
+			return nil, err
+		}
+		r.tls = reloader
+		for _, server := range r.servers() {
+			server.TLSConfig = reloader.tlsConfig()
+		}
+	}
+
+	return r, nil
 }
 
-// Run functions starts server
+// newServer returns server of handler listening on host:port with timeouts of Config
+func (r *Router) newServer(host, port string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf("%s:%s", host, port),
+		Handler:           handler,
+		ReadHeaderTimeout: r.cfg.ReadHeaderTimeout,
+		ReadTimeout:       r.cfg.ReadTimeout,
+		WriteTimeout:      r.cfg.WriteTimeout,
+		IdleTimeout:       r.cfg.IdleTimeout,
+	}
+}
+
+// servers returns main server and admin one if it is configured
+func (r *Router) servers() []*http.Server {
+	if r.admin == nil {
+		return []*http.Server{r.server}
+	}
+	return []*http.Server{r.server, r.admin}
+}
+
+// clientAuth authenticates OAuth clients with verified TLS client certificate
+// listed in Config.ClientCertNames or with HTTP Basic auth. Client id (common name
+// of the certificate or Basic auth user) is put into request context
+func (r *Router) clientAuth(next http.Handler) http.Handler {
+	basicAuth := middleware.BasicAuth("auth", r.cfg.Clients)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientId, _, _ := req.BasicAuth()
+		next.ServeHTTP(w, req.WithContext(models.WithClientId(req.Context(), clientId)))
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 &&
+			slices.Contains(r.cfg.ClientCertNames, req.TLS.VerifiedChains[0][0].Subject.CommonName) {
+			clientId := req.TLS.VerifiedChains[0][0].Subject.CommonName
+			next.ServeHTTP(w, req.WithContext(models.WithClientId(req.Context(), clientId)))
+			return
+		}
+		basicAuth.ServeHTTP(w, req)
+	})
+}
+
+// Run functions starts main and admin servers. Returns when any of them stops,
+// nil after Shutdown
 func (r *Router) Run() error {
-	return http.ListenAndServe(fmt.Sprintf("%s:%s", r.cfg.Host, r.cfg.Port), r.router)
+	if r.tls != nil && r.cfg.CertCheckInterval > 0 {
+		go r.tls.watch(r.watchCtx, r.cfg.CertCheckInterval)
+	}
+
+	servers := r.servers()
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			errs <- r.serve(server)
+		}(server)
+	}
+	return <-errs
+}
+
+// serve serves server with TLS if it is enabled. Returns nil after Shutdown
+func (r *Router) serve(server *http.Server) error {
+	var err error
+	if r.tls != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%s: %w", server.Addr, err)
+	}
+	return nil
+}
+
+// ReloadTLS rereads certificate, key and client CAs. Does nothing if TLS is disabled
+func (r *Router) ReloadTLS() error {
+	if r.tls == nil {
+		return nil
+	}
+	return r.tls.load()
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests
+// until Config.ShutdownTimeout has passed or ctx is done
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.stopWatch()
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.ShutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, server := range r.servers() {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,119 @@
+package router
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"restAuthPart/internal/metrics"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowService holds /refresh until release is closed and fails readiness when draining
+type slowService struct {
+	okService
+	started  chan struct{}
+	release  chan struct{}
+	draining atomic.Bool
+}
+
+func (s *slowService) Refresh() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		close(s.started)
+		<-s.release
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *slowService) Readyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// freePort returns a port which was free a moment ago
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// status requests url and returns the response status code, zero if the request failed
+func status(method, url string) int {
+	req, _ := http.NewRequest(method, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	// Arrange
+	svc := &slowService{started: make(chan struct{}), release: make(chan struct{})}
+	port := freePort(t)
+	r, err := New(&Config{
+		Host:            "127.0.0.1",
+		Port:            port,
+		RequestTimeout:  5 * time.Second,
+		ShutdownTimeout: 5 * time.Second,
+	}, svc, metrics.New(), noTracing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://127.0.0.1:" + port
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- r.Run() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for status("GET", base+"/readyz") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	slowStatus := make(chan int, 1)
+	go func() { slowStatus <- status("POST", base+"/refresh/") }()
+	<-svc.started
+
+	// Act
+	svc.draining.Store(true)
+	readyStatus := status("GET", base+"/readyz")
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- r.Shutdown(context.Background()) }()
+	// Shutdown must wait for the in-flight request
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before in-flight request completed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(svc.release)
+
+	// Assert
+	if readyStatus != http.StatusServiceUnavailable {
+		t.Errorf("readiness returned wrong status code while draining: got %v want %v", readyStatus, http.StatusServiceUnavailable)
+	}
+	if got := <-slowStatus; got != http.StatusOK {
+		t.Errorf("in-flight request returned wrong status code: got %v want %v", got, http.StatusOK)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown returned error: %v", err)
+	}
+	if err := <-runErr; err != nil {
+		t.Errorf("Run returned error: %v", err)
+	}
+}
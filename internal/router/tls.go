@@ -0,0 +1,168 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsVersions maps Config.MinTLSVersion values to tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsReloader keeps server certificate and client CAs loaded from files of Config.
+// Handshakes use the latest loaded files, so they can be replaced without restart
+type tlsReloader struct {
+	cfg        *Config
+	minVersion uint16
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// newTLSReloader loads files of cfg
+func newTLSReloader(cfg *Config) (*tlsReloader, error) {
+	minVersion, ok := tlsVersions[cfg.MinTLSVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version: %q", cfg.MinTLSVersion)
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return nil, errors.New("client certificates can't be required without client CA file")
+	}
+
+	t := &tlsReloader{
+		cfg:        cfg,
+		minVersion: minVersion,
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// files returns paths of loaded files
+func (t *tlsReloader) files() []string {
+	files := []string{t.cfg.CertFile, t.cfg.KeyFile}
+	if t.cfg.ClientCAFile != "" {
+		files = append(files, t.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// load reads certificate, key and client CAs. Previous ones are kept on error
+func (t *tlsReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range t.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.cfg.CertFile, t.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if t.cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(t.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in %s", t.cfg.ClientCAFile)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cert = &cert
+	t.clientCAs = clientCAs
+	t.modTimes = modTimes
+	return nil
+}
+
+// changed reports whether any of the files was modified since the last load
+func (t *tlsReloader) changed() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for file, modTime := range t.modTimes {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads files every interval if they have changed until ctx is done
+func (t *tlsReloader) watch(ctx context.Context, interval time.Duration) {
+	logger := slog.With(slog.String("module", "Router.watchTLS"))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !t.changed() {
+			continue
+		}
+		if err := t.load(); err != nil {
+			logger.Error("Cannot reload TLS certificates", slog.String("err", err.Error()))
+			continue
+		}
+		logger.Info("TLS certificates reloaded")
+	}
+}
+
+// tlsConfig returns server config which uses the latest loaded files.
+// Client certificates are verified when Config.ClientCAFile is set
+// and required if Config.RequireClientCert is set too
+func (t *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: t.minVersion,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			return t.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   t.minVersion,
+				Certificates: []tls.Certificate{*t.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if t.clientCAs != nil {
+				cfg.ClientCAs = t.clientCAs
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				if t.cfg.RequireClientCert {
+					cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return cfg, nil
+		},
+	}
+}
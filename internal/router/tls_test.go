@@ -0,0 +1,258 @@
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"restAuthPart/internal/metrics"
+	"restAuthPart/internal/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+type okService struct{}
+
+// ok responds with authenticated client id
+func ok() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(models.ClientId(r.Context())))
+	}
+}
+
+func (okService) Auth() http.HandlerFunc          { return ok() }
+func (okService) Refresh() http.HandlerFunc       { return ok() }
+func (okService) Logout() http.HandlerFunc        { return ok() }
+func (okService) LogoutAll() http.HandlerFunc     { return ok() }
+func (okService) Sessions() http.HandlerFunc      { return ok() }
+func (okService) RevokeSession() http.HandlerFunc { return ok() }
+func (okService) Introspect() http.HandlerFunc    { return ok() }
+func (okService) Revoke() http.HandlerFunc        { return ok() }
+func (okService) RevokeUser() http.HandlerFunc    { return ok() }
+func (okService) JWKS() http.HandlerFunc          { return ok() }
+func (okService) Healthz() http.HandlerFunc       { return ok() }
+func (okService) Readyz() http.HandlerFunc        { return ok() }
+
+// noTracing is disabled tracing
+type noTracing struct{}
+
+func (noTracing) Middleware(next http.Handler) http.Handler { return next }
+
+// issuer is a certificate able to sign other certificates
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert creates certificate with common name cn signed by parent, self-signed CA if parent is nil
+func newCert(t *testing.T, cn string, parent *issuer) (*issuer, tls.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer := &issuer{cert: template, key: key}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &issuer{cert: cert, key: key}, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// writeCert writes certificate and its key to PEM files of dir
+func writeCert(t *testing.T, dir string, cert *issuer) (certFile, keyFile string) {
+	t.Helper()
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// serve serves r with its TLS config on a random port and returns the address
+func serve(t *testing.T, r *Router) string {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", r.server.TLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: r.router}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+func TestReloadTLS(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	ca, _ := newCert(t, "ca", nil)
+	first, _ := newCert(t, "first", ca)
+	certFile, keyFile := writeCert(t, dir, first)
+
+	r, err := New(&Config{CertFile: certFile, KeyFile: keyFile, MinTLSVersion: "1.2"}, okService{}, metrics.New(), noTracing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, r)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serverName := func() string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	// Act
+	before := serverName()
+	second, _ := newCert(t, "second", ca)
+	writeCert(t, dir, second)
+	if err := r.ReloadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	after := serverName()
+
+	// Assert
+	if before != "first" || after != "second" {
+		t.Errorf("server returned wrong certificates: got %v, %v want first, second", before, after)
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	ca, _ := newCert(t, "ca", nil)
+	server, _ := newCert(t, "server", ca)
+	certFile, keyFile := writeCert(t, dir, server)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(&Config{
+		CertFile:        certFile,
+		KeyFile:         keyFile,
+		MinTLSVersion:   "1.2",
+		ClientCAFile:    caFile,
+		ClientCertNames: []string{"resource-server"},
+		Clients:         map[string]string{"basic-client": "secret"},
+		RequestTimeout:  time.Second,
+	}, okService{}, metrics.New(), noTracing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, r)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	_, allowed := newCert(t, "resource-server", ca)
+	_, unknown := newCert(t, "unknown", ca)
+	_, untrusted := newCert(t, "resource-server", nil)
+
+	tests := []struct {
+		name       string
+		cert       []tls.Certificate
+		basicAuth  bool
+		wantStatus int
+		wantClient string
+	}{
+		{"Allowed certificate", []tls.Certificate{allowed}, false, http.StatusOK, "resource-server"},
+		{"Unknown common name", []tls.Certificate{unknown}, false, http.StatusUnauthorized, ""},
+		{"Certificate of other CA", []tls.Certificate{untrusted}, false, http.StatusUnauthorized, ""},
+		{"No certificate", nil, false, http.StatusUnauthorized, ""},
+		{"Basic auth", nil, true, http.StatusOK, "basic-client"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs: roots, ServerName: "localhost", Certificates: tt.cert,
+			}}}
+
+			req, _ := http.NewRequest("POST", "https://"+addr+"/introspect", strings.NewReader("token=t"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.basicAuth {
+				req.SetBasicAuth("basic-client", "secret")
+			}
+
+			// Act
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			// Assert
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if resp.StatusCode == http.StatusOK && string(body) != tt.wantClient {
+				t.Errorf("handler got wrong client id: got %v want %v", string(body), tt.wantClient)
+			}
+		})
+	}
+}
+
+func TestRequireClientCertWithoutCA(t *testing.T) {
+	// Arrange
+	ca, _ := newCert(t, "ca", nil)
+	server, _ := newCert(t, "server", ca)
+	certFile, keyFile := writeCert(t, t.TempDir(), server)
+
+	// Act
+	_, err := New(&Config{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		MinTLSVersion:     "1.2",
+		RequireClientCert: true,
+	}, okService{}, metrics.New(), noTracing{})
+
+	// Assert
+	if err == nil {
+		t.Error("New accepted required client certificates without client CA file")
+	}
+}
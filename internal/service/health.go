@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"restAuthPart/internal/models"
+	"time"
+)
+
+// checkTimeout limits every dependency check of readiness
+const checkTimeout = 2 * time.Second
+
+const (
+	statusOk   = "ok"
+	statusFail = "fail"
+)
+
+// SetDraining makes readiness fail. Called when graceful shutdown starts
+func (s *Service) SetDraining() {
+	s.draining.Store(true)
+}
+
+// Healthz returns http.HandlerFunc which reports that the process is alive
+func (s *Service) Healthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, models.HealthJSON{Status: statusOk}, slog.With(slog.String("module", "Service.Healthz")))
+	}
+}
+
+// Readyz returns http.HandlerFunc which checks database, signing keys and email sender.
+// Responds 503 with the failed checks if any of them fails or the server is draining
+func (s *Service) Readyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.String("module", "Service.Readyz"))
+
+		checks := []struct {
+			name  string
+			check func(ctx context.Context) error
+		}{
+			{"shutdown", func(context.Context) error {
+				if s.draining.Load() {
+					return errors.New("draining")
+				}
+				return nil
+			}},
+			{"database", s.db.Ping},
+			{"signingKeys", func(context.Context) error { return s.jwtManager.CheckKeys() }},
+			{"email", s.emailService.Ping},
+		}
+
+		health := models.HealthJSON{Status: statusOk, Checks: make(map[string]models.CheckJSON)}
+		for _, c := range checks {
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			err := c.check(ctx)
+			cancel()
+
+			if err != nil {
+				logger.Warn("Readiness check failed", slog.String("check", c.name), slog.String("err", err.Error()))
+				health.Status = statusFail
+				health.Checks[c.name] = models.CheckJSON{Status: statusFail, Error: err.Error()}
+				continue
+			}
+			health.Checks[c.name] = models.CheckJSON{Status: statusOk}
+		}
+
+		status := http.StatusOK
+		if health.Status != statusOk {
+			status = http.StatusServiceUnavailable
+		}
+		writeHealth(w, status, health, logger)
+	}
+}
+
+// writeHealth writes health as JSON with status code. Health checks must never be cached
+func writeHealth(w http.ResponseWriter, status int, health models.HealthJSON, logger *slog.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		logger.Error("Cannot write encoded json", slog.String("err", err.Error()))
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"log/slog"
+	"net/http"
+	"restAuthPart/internal/models"
+)
+
+// Token types of introspection response and token_type_hint values
+const (
+	tokenTypeAccess  = "access_token"
+	tokenTypeRefresh = "refresh_token"
+)
+
+// Introspect returns http.HandlerFunc which process token introspection request (RFC 7662).
+// Gets token from form and responds whether it is active. Refresh tokens are told apart
+// from access tokens by their stored hash
+func (s *Service) Introspect() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.String("module", "Service.Introspect"))
+
+		token := r.PostFormValue("token")
+		if token == "" {
+			reqErr := &requestError{status: http.StatusBadRequest, reason: reasonInvalidRequest, message: "token is required"}
+			reqErr.write(w, logger)
+			return
+		}
+
+		check := []func(context.Context, string) (models.IntrospectionJSON, error){s.introspectRefresh, s.introspectAccess}
+		if r.PostFormValue("token_type_hint") == tokenTypeAccess {
+			check[0], check[1] = check[1], check[0]
+		}
+
+		response := models.IntrospectionJSON{Active: false}
+		for _, introspect := range check {
+			result, err := introspect(r.Context(), token)
+			if err != nil {
+				reqErr := &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+					message: "Cannot introspect token", err: err}
+				reqErr.write(w, logger)
+				return
+			}
+			if result.Active {
+				response = result
+				break
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.Error("Cannot write encoded json", slog.String("err", err.Error()))
+		}
+	}
+}
+
+// introspectRefresh returns active response if token is stored, unused and not revoked refresh token.
+// Error is returned only if the storage fails
+func (s *Service) introspectRefresh(ctx context.Context, token string) (models.IntrospectionJSON, error) {
+	tokenFromDb, err := s.db.GetRefreshTokenByHash(ctx, s.jwtManager.HashToken(token))
+	if errors.Is(err, models.ErrNotFound) {
+		return models.IntrospectionJSON{}, nil
+	}
+	if err != nil {
+		return models.IntrospectionJSON{}, err
+	}
+	if tokenFromDb.UsedAt != nil || tokenFromDb.RevokedAt != nil {
+		return models.IntrospectionJSON{}, nil
+	}
+
+	claims, err := s.getClaims(ctx, token, &models.RefreshTokenClaims{})
+	if err != nil {
+		return models.IntrospectionJSON{}, nil
+	}
+	refreshClaims, ok := claims.(*models.RefreshTokenClaims)
+	if !ok || refreshClaims.Guid != tokenFromDb.UserId {
+		return models.IntrospectionJSON{}, nil
+	}
+
+	return introspectionJSON(refreshClaims.Guid.String(), refreshClaims.RegisteredClaims, tokenTypeRefresh), nil
+}
+
+// introspectAccess returns active response if token is valid and not revoked access token
+func (s *Service) introspectAccess(ctx context.Context, token string) (models.IntrospectionJSON, error) {
+	accessClaims, reqErr := s.checkAccessToken(ctx, token)
+	if reqErr != nil {
+		if reqErr.status >= http.StatusInternalServerError {
+			return models.IntrospectionJSON{}, reqErr.err
+		}
+		return models.IntrospectionJSON{}, nil
+	}
+
+	return introspectionJSON(accessClaims.Guid.String(), accessClaims.RegisteredClaims, tokenTypeAccess), nil
+}
+
+// introspectionJSON returns active response with registered claims of the token
+func introspectionJSON(sub string, claims jwt.RegisteredClaims, tokenType string) models.IntrospectionJSON {
+	response := models.IntrospectionJSON{
+		Active:    true,
+		Sub:       sub,
+		TokenType: tokenType,
+	}
+	if claims.ExpiresAt != nil {
+		response.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.Iat = claims.IssuedAt.Unix()
+	}
+	return response
+}
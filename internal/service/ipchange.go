@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"net/http"
+	"restAuthPart/internal/models"
+)
+
+// applyIPPolicy decides what to do with refresh from ip other than the one refresh token
+// was issued to. Every decision on a changed ip is logged and stored in the audit trail.
+// Returns error if the session must not be continued
+func (s *Service) applyIPPolicy(ctx context.Context, logger *slog.Logger, pair *tokenPair, ip string) (reqErr *requestError) {
+	ctx, span := tracer.Start(ctx, "Service.applyIPPolicy")
+	defer func() { endStep(span, reqErr) }()
+
+	event := s.ipPolicy.Evaluate(pair.refreshClaims.Ip, ip)
+	if event.OldIp == event.NewIp {
+		return nil
+	}
+	event.UserId, event.FamilyId = pair.refreshClaims.Guid, pair.stored.FamilyId
+	span.SetAttributes(attribute.String("ip_change.action", event.Action), attribute.String("ip_change.rule", event.Rule))
+
+	logger.Info("Client ip changed", slog.String("guid", event.UserId.String()),
+		slog.String("family", event.FamilyId.String()), slog.String("old_ip", event.OldIp),
+		slog.String("new_ip", event.NewIp), slog.String("action", event.Action), slog.String("rule", event.Rule))
+	// Audit must not be interrupted if the client goes away
+	if err := s.db.AddIPChangeEvent(context.WithoutCancel(ctx), event); err != nil {
+		logger.Error("Cannot add ip change event to audit trail", slog.String("err", err.Error()))
+	}
+
+	switch event.Action {
+	case models.IPChangeWarn:
+		s.metrics.IPChangeWarning()
+		s.warnUser(ctx, logger, event.UserId)
+	case models.IPChangeReauth:
+		s.revokeFamily(ctx, logger, event.FamilyId)
+		return &requestError{status: http.StatusUnauthorized, reason: reasonReauthRequired,
+			message: "Client ip changed, authenticate again"}
+	case models.IPChangeBlock:
+		s.revokeFamily(ctx, logger, event.FamilyId)
+		s.warnUser(ctx, logger, event.UserId)
+		return &requestError{status: http.StatusForbidden, reason: reasonIPBlocked,
+			message: "Refresh from this ip is not allowed"}
+	}
+	return nil
+}
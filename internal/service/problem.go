@@ -0,0 +1,99 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"log/slog"
+	"net/http"
+	"restAuthPart/internal/models"
+)
+
+// Reasons of failed requests. They are reported to metrics and, except for
+// reasonDBError, returned to clients as the stable code of problem details
+const (
+	reasonNone           = "none"
+	reasonInvalidRequest = "invalid_request"
+	reasonInvalidGuid    = "invalid_guid"
+	reasonInvalidToken   = "invalid_token"
+	reasonTokenExpired   = "token_expired"
+	reasonGuidMismatch   = "guid_mismatch"
+	reasonTokenMismatch  = "token_mismatch"
+	reasonTokenRevoked   = "token_revoked"
+	reasonTokenReused    = "token_reused"
+	reasonSessionExpired = "session_expired"
+	reasonReauthRequired = "reauth_required"
+	reasonIPBlocked      = "ip_blocked"
+	reasonNotFound       = "not_found"
+	reasonDBError        = "db_error"
+	reasonInternal       = "internal"
+)
+
+// requestError is a failed check of the request with the status to respond with.
+// Message is shown to the client unless the error is internal, err goes only to logs
+type requestError struct {
+	status  int
+	reason  string
+	message string
+	err     error
+}
+
+// reasonOrNone returns reason of the error or reasonNone for successful request
+func (e *requestError) reasonOrNone() string {
+	if e == nil {
+		return reasonNone
+	}
+	return e.reason
+}
+
+// code returns code of the error shown to the client. Storage failures are internal errors
+func (e *requestError) code() string {
+	if e.reason == reasonDBError {
+		return reasonInternal
+	}
+	return e.reason
+}
+
+// write responds with the error as application/problem+json and logs it
+func (e *requestError) write(w http.ResponseWriter, logger *slog.Logger) {
+	detail := e.message
+	if e.status >= http.StatusInternalServerError {
+		detail = "Internal server error"
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(e.status)
+	if err := json.NewEncoder(w).Encode(models.ProblemJSON{
+		Type:   "about:blank",
+		Title:  http.StatusText(e.status),
+		Status: e.status,
+		Detail: detail,
+		Code:   e.code(),
+	}); err != nil {
+		logger.Error("Cannot write encoded json", slog.String("err", err.Error()))
+	}
+
+	if e.err != nil {
+		logger.Error(e.message, slog.String("code", e.code()), slog.String("err", e.err.Error()))
+	} else {
+		logger.Error(e.message, slog.String("code", e.code()))
+	}
+}
+
+// storageError returns requestError with notFoundStatus if err is models.ErrNotFound
+// and with http.StatusInternalServerError otherwise
+func storageError(err error, notFoundStatus int) *requestError {
+	if errors.Is(err, models.ErrNotFound) {
+		return &requestError{status: notFoundStatus, reason: reasonNotFound, message: "Token refers to unknown user or session", err: err}
+	}
+	return &requestError{status: http.StatusInternalServerError, reason: reasonDBError, message: "Storage failed", err: err}
+}
+
+// tokenError returns requestError with status for token which can't be parsed or verified
+func tokenError(err error, status int) *requestError {
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return &requestError{status: status, reason: reasonTokenExpired, message: "Token is expired", err: err}
+	}
+	return &requestError{status: status, reason: reasonInvalidToken, message: "Token is invalid", err: err}
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"restAuthPart/internal/models"
+	"time"
+)
+
+// Revoke returns http.HandlerFunc which process token revocation request (RFC 7009).
+// Refresh tokens are revoked in storage, access tokens are added to the deny-list
+// until they expire. Responds with 200 even for unknown tokens as the RFC requires
+func (s *Service) Revoke() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.String("module", "Service.Revoke"))
+
+		token := r.PostFormValue("token")
+		if token == "" {
+			reqErr := &requestError{status: http.StatusBadRequest, reason: reasonInvalidRequest, message: "token is required"}
+			reqErr.write(w, logger)
+			return
+		}
+
+		revoke := []func(context.Context, string) (bool, error){s.revokeRefresh, s.revokeAccess}
+		if r.PostFormValue("token_type_hint") == tokenTypeAccess {
+			revoke[0], revoke[1] = revoke[1], revoke[0]
+		}
+
+		for _, try := range revoke {
+			revoked, err := try(r.Context(), token)
+			if err != nil {
+				reqErr := &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+					message: "Cannot revoke token", err: err}
+				reqErr.write(w, logger)
+				return
+			}
+			if revoked {
+				break
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// RevokeUser returns http.HandlerFunc which revokes every session of the user from URL
+// for a compromised account. Access tokens issued before optional revoked_before form
+// parameter (RFC 3339, now by default) are rejected too
+func (s *Service) RevokeUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.String("module", "Service.RevokeUser"))
+
+		guid, err := uuid.Parse(chi.URLParam(r, "guid"))
+		if err != nil {
+			reqErr := &requestError{status: http.StatusBadRequest, reason: reasonInvalidGuid, message: "GUID must be a UUID", err: err}
+			reqErr.write(w, logger)
+			return
+		}
+
+		revokedBefore := time.Now()
+		if value := r.PostFormValue("revoked_before"); value != "" {
+			revokedBefore, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				reqErr := &requestError{status: http.StatusBadRequest, reason: reasonInvalidRequest,
+					message: "revoked_before must be an RFC 3339 timestamp", err: err}
+				reqErr.write(w, logger)
+				return
+			}
+			if revokedBefore.After(time.Now()) {
+				reqErr := &requestError{status: http.StatusBadRequest, reason: reasonInvalidRequest,
+					message: "revoked_before must not be in the future", err: fmt.Errorf("revoked_before %s", value)}
+				reqErr.write(w, logger)
+				return
+			}
+		}
+
+		err = s.db.RevokeUserTokens(r.Context(), guid, revokedBefore)
+		if errors.Is(err, models.ErrNotFound) {
+			reqErr := &requestError{status: http.StatusNotFound, reason: reasonNotFound, message: "User not found", err: err}
+			reqErr.write(w, logger)
+			return
+		}
+		if err != nil {
+			reqErr := &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+				message: "Cannot revoke user tokens", err: err}
+			reqErr.write(w, logger)
+			return
+		}
+
+		logger.Info("All sessions revoked", slog.String("guid", guid.String()),
+			slog.Time("revoked_before", revokedBefore), slog.String("client", models.ClientId(r.Context())))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// revokeRefresh revokes token if it is a stored refresh token. Returns false for other tokens
+func (s *Service) revokeRefresh(ctx context.Context, token string) (bool, error) {
+	tokenFromDb, err := s.db.GetRefreshTokenByHash(ctx, s.jwtManager.HashToken(token))
+	if errors.Is(err, models.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, s.db.RevokeRefreshToken(ctx, tokenFromDb.Id)
+}
+
+// revokeAccess adds token id to the deny-list if it is a valid access token.
+// Returns false for other tokens
+func (s *Service) revokeAccess(ctx context.Context, token string) (bool, error) {
+	claims, err := s.getClaims(ctx, token, &models.AccessTokenClaims{})
+	if err != nil {
+		return false, nil
+	}
+	// Refresh tokens are parsed as access claims too, but without refreshId
+	accessClaims, ok := claims.(*models.AccessTokenClaims)
+	if !ok || accessClaims.RefreshId == 0 {
+		return false, nil
+	}
+
+	if accessClaims.ID == "" || accessClaims.ExpiresAt == nil {
+		// Tokens issued before jti was introduced can't be denied, they expire soon anyway
+		slog.Warn("Access token without jti can't be revoked", slog.String("guid", accessClaims.Guid.String()))
+		return true, nil
+	}
+
+	return true, s.db.DenyAccessToken(ctx, accessClaims.ID, accessClaims.ExpiresAt.Time)
+}
@@ -1,7 +1,9 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
@@ -9,24 +11,55 @@ import (
 	"log/slog"
 	"net/http"
 	"restAuthPart/internal/models"
+	"sync/atomic"
+	"time"
 )
 
 type IJWTManager interface {
-	GenerateRefreshToken(guid uuid.UUID, ip string) (string, error)
-	GenerateAccessToken(guid uuid.UUID, ip string, id int) (string, error)
+	GenerateRefreshToken(guid uuid.UUID, ip string, sessionStart time.Time) (string, error)
+	GenerateAccessToken(guid uuid.UUID, ip string, id int, sessionStart time.Time) (string, error)
 	GetClaims(token string, claimsType jwt.Claims) (jwt.Claims, error)
+	GetClaimsIgnoringExpiry(token string, claimsType jwt.Claims) (jwt.Claims, bool, error)
+	HashToken(token string) []byte
 	CompareTokens(token string, hashedToken []byte) bool
+	JWKS() models.JWKSet
+	CheckKeys() error
+	RefreshTTL() time.Duration
 }
 
 type IDatabase interface {
-	AddUserIfNotExist(user models.User) error
-	AddRefreshToken(token string, guid uuid.UUID) (int, error)
-	GetRefreshToken(refreshTokenId int) ([]byte, error)
-	GetUser(guid uuid.UUID) (models.User, error)
+	AddUserIfNotExist(ctx context.Context, user models.User) error
+	AddTokenFamily(ctx context.Context, guid uuid.UUID) (uuid.UUID, error)
+	AddRefreshToken(ctx context.Context, token models.RefreshToken) (int, error)
+	GetRefreshToken(ctx context.Context, refreshTokenId int) (models.RefreshToken, error)
+	GetRefreshTokenByHash(ctx context.Context, tokenHash []byte) (models.RefreshToken, error)
+	MarkRefreshTokenUsed(ctx context.Context, refreshTokenId int, ip string) (bool, error)
+	RevokeTokenFamily(ctx context.Context, familyId uuid.UUID) error
+	RevokeRefreshToken(ctx context.Context, refreshTokenId int) error
+	GetUser(ctx context.Context, guid uuid.UUID) (models.User, error)
+	RevokeUserTokens(ctx context.Context, guid uuid.UUID, revokedBefore time.Time) error
+	DenyAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsAccessTokenDenied(ctx context.Context, jti string) (bool, error)
+	GetSessions(ctx context.Context, guid uuid.UUID, createdAfter time.Time) ([]models.Session, error)
+	RevokeSession(ctx context.Context, guid uuid.UUID, sessionId uuid.UUID) (bool, error)
+	AddIPChangeEvent(ctx context.Context, event models.IPChangeEvent) error
+	Ping(ctx context.Context) error
+}
+
+type IMetrics interface {
+	AuthRequest(reason string)
+	RefreshRequest(reason string)
+	IPChangeWarning()
+	TokensIssued()
+}
+
+type IIPPolicy interface {
+	Evaluate(oldIp, newIp string) models.IPChangeEvent
 }
 
 type IEmailService interface {
 	SendWarning(email string) error
+	Ping(ctx context.Context) error
 }
 
 // Service ...
@@ -34,14 +67,19 @@ type Service struct {
 	jwtManager   IJWTManager
 	db           IDatabase
 	emailService IEmailService
+	metrics      IMetrics
+	ipPolicy     IIPPolicy
+	draining     atomic.Bool
 }
 
 // New ...
-func New(manager IJWTManager, db IDatabase, emailService IEmailService) *Service {
+func New(manager IJWTManager, db IDatabase, emailService IEmailService, metrics IMetrics, ipPolicy IIPPolicy) *Service {
 	return &Service{
 		jwtManager:   manager,
 		db:           db,
 		emailService: emailService,
+		metrics:      metrics,
+		ipPolicy:     ipPolicy,
 	}
 }
 
@@ -50,139 +88,252 @@ func New(manager IJWTManager, db IDatabase, emailService IEmailService) *Service
 // to ResponseWriter
 func (s *Service) Auth() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Get guid from request and generate access and refresh tokens for it then
 		logger := slog.With(slog.String("module", "Service.Auth"))
-		guidString := chi.URLParam(r, "guid")
-		guid, err := uuid.Parse(guidString)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			logger.Error("Cannot parse uuid", slog.String("err", err.Error()))
-			return
-		}
 
-		if err := s.db.AddUserIfNotExist(models.User{Guid: guid, Ip: r.RemoteAddr}); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			logger.Error("Cannot add user", slog.String("err", err.Error()))
+		tokenJson, reqErr := s.auth(r)
+		s.metrics.AuthRequest(reqErr.reasonOrNone())
+		if reqErr != nil {
+			reqErr.write(w, logger)
 			return
 		}
 
-		// Generate refresh token and then get th
-		rToken, err := s.jwtManager.GenerateRefreshToken(guid, r.RemoteAddr)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Cannot generate refresh token", slog.String("err", err.Error()))
-			return
-		}
+		writeTokens(w, logger, tokenJson)
+	}
+}
 
-		id, err := s.db.AddRefreshToken(rToken, guid)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Cannot add refresh token to DB", slog.String("err", err.Error()))
-			return
-		}
+// auth gets guid from request and generates access and refresh tokens for it then
+func (s *Service) auth(r *http.Request) (_ models.AccessRefreshJSON, reqErr *requestError) {
+	ctx, span := tracer.Start(r.Context(), "Service.auth")
+	defer func() { endStep(span, reqErr) }()
 
-		accessToken, err := s.jwtManager.GenerateAccessToken(guid, r.RemoteAddr, id)
-		if err != nil {
-			logger.Error("Cannot generate access token", slog.String("err", err.Error()))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	guidString := chi.URLParam(r, "guid")
+	guid, err := uuid.Parse(guidString)
+	if err != nil {
+		return models.AccessRefreshJSON{}, &requestError{status: http.StatusBadRequest, reason: reasonInvalidGuid,
+			message: "GUID must be a UUID", err: err}
+	}
 
-		tokenJson := models.AccessRefreshJSON{AccessT: accessToken, RefreshT: rToken}
-		w.WriteHeader(http.StatusAccepted)
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(tokenJson); err != nil {
-			logger.Error("Cannot write encoded json", slog.String("err", err.Error()))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	if err := s.db.AddUserIfNotExist(ctx, models.User{Guid: guid, Ip: r.RemoteAddr}); err != nil {
+		return models.AccessRefreshJSON{}, &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+			message: "Cannot add user", err: err}
 	}
+
+	familyId, err := s.db.AddTokenFamily(ctx, guid)
+	if err != nil {
+		return models.AccessRefreshJSON{}, &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+			message: "Cannot add token family to DB", err: err}
+	}
+
+	return s.issueTokens(ctx, guid, familyId, time.Now(), r.RemoteAddr, r.UserAgent())
 }
 
 // Refresh returns http.HandlerFunc which process the refresh request
-// gets Refresh token and returns new Access and Refresh tokens
+// gets Refresh token and returns new Access and Refresh tokens.
+// Presented refresh token is marked as used, using it again revokes
+// the whole token family and warns the user
 func (s *Service) Refresh() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := slog.With(slog.String("module", "Service.Refresh"))
 
-		var data models.RefreshTokenJSON
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, "Can't parse json", http.StatusBadRequest)
-			logger.Error("Can't parse json", slog.String("err", err.Error()))
+		tokenJson, reqErr := s.refresh(r, logger)
+		s.metrics.RefreshRequest(reqErr.reasonOrNone())
+		if reqErr != nil {
+			reqErr.write(w, logger)
 			return
 		}
 
-		refreshClaims, err := s.jwtManager.GetClaims(data.RefreshT, &models.RefreshTokenClaims{})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			logger.Error("Cannot get refreshClaims from token", slog.String("err", err.Error()))
-			return
-		}
+		writeTokens(w, logger, tokenJson)
+	}
+}
+
+// refresh checks token pair from request, marks the refresh token as used and issues new tokens
+func (s *Service) refresh(r *http.Request, logger *slog.Logger) (_ models.AccessRefreshJSON, reqErr *requestError) {
+	ctx, span := tracer.Start(r.Context(), "Service.refresh")
+	defer func() { endStep(span, reqErr) }()
+
+	pair, reqErr := s.checkTokenPair(ctx, r)
+	if reqErr != nil {
+		return models.AccessRefreshJSON{}, reqErr
+	}
 
-		fmt.Println(refreshClaims)
+	unused, err := s.db.MarkRefreshTokenUsed(ctx, pair.stored.Id, r.RemoteAddr)
+	if err != nil {
+		return models.AccessRefreshJSON{}, &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+			message: "Cannot mark refresh token as used", err: err}
+	}
+
+	if !unused {
+		// Token was already exchanged, so either the client or an attacker
+		// holds a stolen copy. Kill the whole session
+		logger.Warn("Refresh token reuse detected", slog.Int("id", pair.stored.Id),
+			slog.String("family", pair.stored.FamilyId.String()))
+		s.revokeFamily(ctx, logger, pair.stored.FamilyId)
+		s.warnUser(ctx, logger, pair.refreshClaims.Guid)
 
-		decodedRefreshClaims, ok := refreshClaims.(*models.RefreshTokenClaims)
-		if !ok {
-			http.Error(w, "Cannot convert refreshClaims to RefreshTokenClaims", http.StatusBadRequest)
-			logger.Error("Cannot convert refreshClaims to RefreshTokenClaims")
+		return models.AccessRefreshJSON{}, &requestError{status: http.StatusUnauthorized, reason: reasonTokenReused,
+			message: "Refresh token was already used"}
+	}
+
+	if reqErr := s.applyIPPolicy(ctx, logger, pair, r.RemoteAddr); reqErr != nil {
+		return models.AccessRefreshJSON{}, reqErr
+	}
+
+	return s.issueTokens(ctx, pair.refreshClaims.Guid, pair.stored.FamilyId, pair.stored.SessionCreatedAt,
+		r.RemoteAddr, r.UserAgent())
+}
+
+// revokeFamily revokes session of the client. Revocation must not be interrupted if the client goes away
+func (s *Service) revokeFamily(ctx context.Context, logger *slog.Logger, familyId uuid.UUID) {
+	if err := s.db.RevokeTokenFamily(context.WithoutCancel(ctx), familyId); err != nil {
+		logger.Error("Cannot revoke token family", slog.String("err", err.Error()))
+	}
+}
+
+// writeTokens writes issued tokens with http.StatusAccepted
+func writeTokens(w http.ResponseWriter, logger *slog.Logger, tokenJson models.AccessRefreshJSON) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(tokenJson); err != nil {
+		logger.Error("Cannot write encoded json", slog.String("err", err.Error()))
+	}
+}
+
+// Logout returns http.HandlerFunc which process the logout request.
+// Gets the same token pair as Refresh and revokes the refresh token,
+// so it can't be used for refresh anymore
+func (s *Service) Logout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.String("module", "Service.Logout"))
+		ctx := r.Context()
+
+		pair, reqErr := s.checkTokenPair(ctx, r)
+		if reqErr != nil {
+			reqErr.write(w, logger)
 			return
 		}
 
-		accessClaims, err := s.jwtManager.GetClaims(data.AccessT, &models.AccessTokenClaims{})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			logger.Error("Cannot get accessClaims from token", slog.String("err", err.Error()))
+		if pair.stored.UsedAt != nil {
+			reqErr := &requestError{status: http.StatusUnauthorized, reason: reasonTokenReused,
+				message: "Refresh token was already used", err: fmt.Errorf("refresh token %d", pair.stored.Id)}
+			reqErr.write(w, logger)
 			return
 		}
 
-		decodedAccessClaims, ok := accessClaims.(*models.AccessTokenClaims)
-
-		if !ok {
-			http.Error(w, "Cannot convert accessClaims to AccessTokenClaims", http.StatusBadRequest)
-			logger.Error("Cannot convert accessClaims to AccessTokenClaims")
+		if err := s.db.RevokeRefreshToken(ctx, pair.stored.Id); err != nil {
+			reqErr := &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+				message: "Cannot revoke refresh token", err: err}
+			reqErr.write(w, logger)
 			return
 		}
 
-		if decodedRefreshClaims.Guid != decodedAccessClaims.Guid {
-			http.Error(w, "Guid from token doesn't match guid from request", http.StatusBadRequest)
-			logger.Error("Guid from token doesn't match guid from request")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// LogoutAll returns http.HandlerFunc which process the "log out everywhere" request.
+// Gets the same token pair as Refresh, revokes every refresh token of the user
+// and rejects all access tokens issued before now. Already used pair is rejected
+func (s *Service) LogoutAll() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.String("module", "Service.LogoutAll"))
+		ctx := r.Context()
+
+		pair, reqErr := s.checkTokenPair(ctx, r)
+		if reqErr != nil {
+			reqErr.write(w, logger)
 			return
 		}
 
-		tokenFromDb, err := s.db.GetRefreshToken(decodedAccessClaims.RefreshId)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			logger.Error("Cannot get token from DB", slog.String("err", err.Error()))
+		if pair.stored.UsedAt != nil {
+			reqErr := &requestError{status: http.StatusUnauthorized, reason: reasonTokenReused,
+				message: "Refresh token was already used", err: fmt.Errorf("refresh token %d", pair.stored.Id)}
+			reqErr.write(w, logger)
 			return
 		}
 
-		if !s.jwtManager.CompareTokens(data.RefreshT, tokenFromDb) {
-			http.Error(w, "Tokens are not identical", http.StatusBadRequest)
-			logger.Error("Tokens are not identical")
+		if err := s.db.RevokeUserTokens(ctx, pair.accessClaims.Guid, time.Now()); err != nil {
+			reqErr := &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+				message: "Cannot revoke user tokens", err: err}
+			reqErr.write(w, logger)
 			return
 		}
 
-		if decodedRefreshClaims.Ip != r.RemoteAddr {
-			user, err := s.db.GetUser(decodedRefreshClaims.Guid)
-			if err != nil {
-				logger.Error("Cannot get user from DB", slog.String("err", err.Error()))
-			}
+		logger.Info("All sessions revoked", slog.String("guid", pair.accessClaims.Guid.String()))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
 
-			if err := s.emailService.SendWarning(user.Email); err != nil {
-				logger.Error("Cannot send warning message to user", slog.String("err", err.Error()))
-			}
-		}
+// issueTokens generates new refresh token of the family started at sessionStart, saves it
+// with client's ip and User-Agent and generates access token bound to it
+func (s *Service) issueTokens(ctx context.Context, guid uuid.UUID, familyId uuid.UUID, sessionStart time.Time, ip, userAgent string) (_ models.AccessRefreshJSON, reqErr *requestError) {
+	ctx, span := tracer.Start(ctx, "Service.issueTokens")
+	defer func() { endStep(span, reqErr) }()
 
-		accessToken, err := s.jwtManager.GenerateAccessToken(decodedRefreshClaims.Guid, r.RemoteAddr, decodedAccessClaims.RefreshId)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Cannot generate access token", slog.String("err", err.Error()))
-			return
-		}
+	refreshToken, err := s.generateRefreshToken(ctx, guid, ip, sessionStart)
+	if err != nil {
+		return models.AccessRefreshJSON{}, generationError(err, familyId)
+	}
+
+	id, err := s.db.AddRefreshToken(ctx, models.RefreshToken{
+		UserId:    guid,
+		FamilyId:  familyId,
+		Token:     s.jwtManager.HashToken(refreshToken),
+		CreatedIp: ip,
+		UserAgent: userAgent,
+	})
+	if err != nil {
+		return models.AccessRefreshJSON{}, &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+			message: "Cannot add refresh token to DB", err: err}
+	}
+
+	accessToken, err := s.generateAccessToken(ctx, guid, ip, id, sessionStart)
+	if err != nil {
+		return models.AccessRefreshJSON{}, generationError(err, familyId)
+	}
+
+	s.metrics.TokensIssued()
+	return models.AccessRefreshJSON{AccessT: accessToken, RefreshT: refreshToken}, nil
+}
+
+// generationError returns requestError for failed token generation.
+// Session which has reached its maximum lifetime requires new authentication
+func generationError(err error, familyId uuid.UUID) *requestError {
+	if errors.Is(err, models.ErrSessionExpired) {
+		return &requestError{status: http.StatusUnauthorized, reason: reasonSessionExpired,
+			message: "Session expired, authenticate again", err: fmt.Errorf("family %s: %w", familyId, err)}
+	}
+	return &requestError{status: http.StatusInternalServerError, reason: reasonInternal,
+		message: "Cannot generate token", err: err}
+}
+
+// warnUser sends warning about suspicious activity to the user's email
+func (s *Service) warnUser(ctx context.Context, logger *slog.Logger, guid uuid.UUID) {
+	ctx, span := tracer.Start(ctx, "Service.warnUser")
+	defer span.End()
+
+	user, err := s.db.GetUser(ctx, guid)
+	if err != nil {
+		logger.Error("Cannot get user from DB", slog.String("err", err.Error()))
+		return
+	}
+
+	_, sendSpan := tracer.Start(ctx, "email.SendWarning")
+	err = s.emailService.SendWarning(user.Email)
+	endSpan(sendSpan, err)
+	if err != nil {
+		logger.Error("Cannot send warning message to user", slog.String("err", err.Error()))
+	}
+}
+
+// JWKS returns http.HandlerFunc which writes public keys
+// for access token verification by other services
+func (s *Service) JWKS() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.String("module", "Service.JWKS"))
 
-		w.WriteHeader(http.StatusAccepted)
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(models.AccessRefreshJSON{AccessT: accessToken, RefreshT: data.RefreshT}); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := json.NewEncoder(w).Encode(s.jwtManager.JWKS()); err != nil {
 			logger.Error("Cannot write encoded json", slog.String("err", err.Error()))
 		}
 	}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Sessions returns http.HandlerFunc which lists active sessions
+// of the access token owner with their device and IP metadata
+func (s *Service) Sessions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.String("module", "Service.Sessions"))
+		ctx := r.Context()
+
+		claims, reqErr := s.authenticate(r)
+		if reqErr != nil {
+			reqErr.write(w, logger)
+			return
+		}
+
+		// Sessions without refresh token issued within its lifetime are expired
+		sessions, err := s.db.GetSessions(ctx, claims.Guid, time.Now().Add(-s.jwtManager.RefreshTTL()))
+		if err != nil {
+			reqErr := &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+				message: "Cannot get sessions from DB", err: err}
+			reqErr.write(w, logger)
+			return
+		}
+
+		for i := range sessions {
+			sessions[i].Current = sessions[i].RefreshId == claims.RefreshId
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sessions); err != nil {
+			logger.Error("Cannot write encoded json", slog.String("err", err.Error()))
+		}
+	}
+}
+
+// RevokeSession returns http.HandlerFunc which revokes one session
+// of the access token owner by its id
+func (s *Service) RevokeSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.String("module", "Service.RevokeSession"))
+		ctx := r.Context()
+
+		claims, reqErr := s.authenticate(r)
+		if reqErr != nil {
+			reqErr.write(w, logger)
+			return
+		}
+
+		sessionId, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			reqErr := &requestError{status: http.StatusBadRequest, reason: reasonInvalidRequest,
+				message: "Session id must be a UUID", err: err}
+			reqErr.write(w, logger)
+			return
+		}
+
+		revoked, err := s.db.RevokeSession(ctx, claims.Guid, sessionId)
+		if err != nil {
+			reqErr := &requestError{status: http.StatusInternalServerError, reason: reasonDBError,
+				message: "Cannot revoke session", err: err}
+			reqErr.write(w, logger)
+			return
+		}
+		if !revoked {
+			reqErr := &requestError{status: http.StatusNotFound, reason: reasonNotFound,
+				message: "Session not found", err: fmt.Errorf("session %s", sessionId)}
+			reqErr.write(w, logger)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
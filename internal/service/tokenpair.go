@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"restAuthPart/internal/models"
+	"strings"
+	"time"
+)
+
+// tokenPair is a checked pair of access and refresh tokens with the stored refresh token
+type tokenPair struct {
+	refreshT      string
+	refreshClaims *models.RefreshTokenClaims
+	accessClaims  *models.AccessTokenClaims
+	stored        models.RefreshToken
+}
+
+// checkTokenPair reads models.RefreshTokenJSON from request body and checks that both tokens
+// are valid, belong to the same user and refresh token is stored and not revoked.
+// Expired access token is accepted, it is why clients refresh. Expired refresh token is rejected
+// only if it is unused, so replay of a used one still reaches reuse detection of the caller
+func (s *Service) checkTokenPair(ctx context.Context, r *http.Request) (_ *tokenPair, reqErr *requestError) {
+	ctx, span := tracer.Start(ctx, "Service.checkTokenPair")
+	defer func() { endStep(span, reqErr) }()
+
+	var data models.RefreshTokenJSON
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, reason: reasonInvalidRequest, message: "Can't parse json", err: err}
+	}
+
+	refreshClaims, refreshExpired, err := s.getClaimsIgnoringExpiry(ctx, data.RefreshT, &models.RefreshTokenClaims{})
+	if err != nil {
+		return nil, tokenError(err, http.StatusBadRequest)
+	}
+
+	decodedRefreshClaims, ok := refreshClaims.(*models.RefreshTokenClaims)
+	if !ok {
+		return nil, &requestError{status: http.StatusBadRequest, reason: reasonInvalidToken, message: "Token is invalid", err: errors.New("cannot convert refreshClaims to RefreshTokenClaims")}
+	}
+
+	accessClaims, _, err := s.getClaimsIgnoringExpiry(ctx, data.AccessT, &models.AccessTokenClaims{})
+	if err != nil {
+		return nil, tokenError(err, http.StatusBadRequest)
+	}
+
+	decodedAccessClaims, ok := accessClaims.(*models.AccessTokenClaims)
+	if !ok {
+		return nil, &requestError{status: http.StatusBadRequest, reason: reasonInvalidToken, message: "Token is invalid", err: errors.New("cannot convert accessClaims to AccessTokenClaims")}
+	}
+
+	if decodedRefreshClaims.Guid != decodedAccessClaims.Guid {
+		return nil, &requestError{status: http.StatusBadRequest, reason: reasonGuidMismatch, message: "Access and refresh tokens belong to different users"}
+	}
+
+	if reqErr := s.checkUserRevocation(ctx, decodedAccessClaims); reqErr != nil {
+		return nil, reqErr
+	}
+
+	tokenFromDb, err := s.db.GetRefreshToken(ctx, decodedAccessClaims.RefreshId)
+	if err != nil {
+		return nil, storageError(err, http.StatusBadRequest)
+	}
+
+	if !s.compareTokens(ctx, data.RefreshT, tokenFromDb.Token) {
+		return nil, &requestError{status: http.StatusBadRequest, reason: reasonTokenMismatch, message: "Refresh token doesn't match access token"}
+	}
+
+	if tokenFromDb.RevokedAt != nil {
+		return nil, &requestError{status: http.StatusUnauthorized, reason: reasonTokenRevoked, message: "Refresh token is revoked"}
+	}
+
+	if refreshExpired && tokenFromDb.UsedAt == nil {
+		return nil, &requestError{status: http.StatusBadRequest, reason: reasonTokenExpired, message: "Token is expired"}
+	}
+
+	return &tokenPair{
+		refreshT:      data.RefreshT,
+		refreshClaims: decodedRefreshClaims,
+		accessClaims:  decodedAccessClaims,
+		stored:        tokenFromDb,
+	}, nil
+}
+
+// checkUserRevocation rejects access token issued before user's sessions were revoked
+func (s *Service) checkUserRevocation(ctx context.Context, claims *models.AccessTokenClaims) (reqErr *requestError) {
+	ctx, span := tracer.Start(ctx, "Service.checkUserRevocation")
+	defer func() { endStep(span, reqErr) }()
+
+	user, err := s.db.GetUser(ctx, claims.Guid)
+	if err != nil {
+		return storageError(err, http.StatusBadRequest)
+	}
+	if user.RevokedBefore == nil {
+		return nil
+	}
+
+	// iat has seconds precision, so compare with revocation time truncated the same way
+	if claims.IssuedAt == nil || claims.IssuedAt.Before(user.RevokedBefore.Truncate(time.Second)) {
+		return &requestError{status: http.StatusUnauthorized, reason: reasonTokenRevoked, message: "Access token is revoked"}
+	}
+	return nil
+}
+
+// authenticate checks access token from Authorization header, see checkAccessToken
+func (s *Service) authenticate(r *http.Request) (*models.AccessTokenClaims, *requestError) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, &requestError{status: http.StatusUnauthorized, reason: reasonInvalidRequest, message: "Bearer token is required"}
+	}
+
+	return s.checkAccessToken(r.Context(), token)
+}
+
+// checkAccessToken checks access token. Token is rejected
+// if the user's sessions or its own refresh token were revoked
+func (s *Service) checkAccessToken(ctx context.Context, token string) (_ *models.AccessTokenClaims, reqErr *requestError) {
+	ctx, span := tracer.Start(ctx, "Service.checkAccessToken")
+	defer func() { endStep(span, reqErr) }()
+
+	claims, err := s.getClaims(ctx, token, &models.AccessTokenClaims{})
+	if err != nil {
+		return nil, tokenError(err, http.StatusUnauthorized)
+	}
+
+	accessClaims, ok := claims.(*models.AccessTokenClaims)
+	if !ok {
+		return nil, &requestError{status: http.StatusUnauthorized, reason: reasonInvalidToken, message: "Token is invalid", err: errors.New("cannot convert accessClaims to AccessTokenClaims")}
+	}
+
+	if reqErr := s.checkUserRevocation(ctx, accessClaims); reqErr != nil {
+		return nil, reqErr
+	}
+
+	if accessClaims.ID != "" {
+		denied, err := s.db.IsAccessTokenDenied(ctx, accessClaims.ID)
+		if err != nil {
+			return nil, storageError(err, http.StatusUnauthorized)
+		}
+		if denied {
+			return nil, &requestError{status: http.StatusUnauthorized, reason: reasonTokenRevoked, message: "Access token is revoked"}
+		}
+	}
+
+	tokenFromDb, err := s.db.GetRefreshToken(ctx, accessClaims.RefreshId)
+	if err != nil {
+		return nil, storageError(err, http.StatusUnauthorized)
+	}
+	if tokenFromDb.RevokedAt != nil {
+		return nil, &requestError{status: http.StatusUnauthorized, reason: reasonTokenRevoked, message: "Refresh token is revoked"}
+	}
+
+	return accessClaims, nil
+}
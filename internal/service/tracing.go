@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// tracer starts spans of service steps and jwt.Manager calls. It is noop unless tracing is enabled
+var tracer = otel.Tracer("restAuthPart/internal/service")
+
+// reasonKey is attribute of span with reason of failed step
+const reasonKey = attribute.Key("auth.failure_reason")
+
+// endSpan ends span recording err if it isn't nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endStep ends span of service step recording reqErr if it isn't nil
+func endStep(span trace.Span, reqErr *requestError) {
+	if reqErr != nil {
+		span.SetAttributes(reasonKey.String(reqErr.reason))
+		span.SetStatus(codes.Error, reqErr.message)
+	}
+	span.End()
+}
+
+// getClaims calls jwt.Manager GetClaims in span
+func (s *Service) getClaims(ctx context.Context, token string, claimsType jwt.Claims) (_ jwt.Claims, err error) {
+	_, span := tracer.Start(ctx, "jwt.GetClaims")
+	defer func() { endSpan(span, err) }()
+	return s.jwtManager.GetClaims(token, claimsType)
+}
+
+// getClaimsIgnoringExpiry calls jwt.Manager GetClaimsIgnoringExpiry in span
+func (s *Service) getClaimsIgnoringExpiry(ctx context.Context, token string, claimsType jwt.Claims) (_ jwt.Claims, expired bool, err error) {
+	_, span := tracer.Start(ctx, "jwt.GetClaimsIgnoringExpiry")
+	defer func() { endSpan(span, err) }()
+	return s.jwtManager.GetClaimsIgnoringExpiry(token, claimsType)
+}
+
+// compareTokens calls jwt.Manager CompareTokens in span
+func (s *Service) compareTokens(ctx context.Context, token string, hashedToken []byte) bool {
+	_, span := tracer.Start(ctx, "jwt.CompareTokens")
+	defer span.End()
+	return s.jwtManager.CompareTokens(token, hashedToken)
+}
+
+// generateRefreshToken calls jwt.Manager GenerateRefreshToken in span
+func (s *Service) generateRefreshToken(ctx context.Context, guid uuid.UUID, ip string, sessionStart time.Time) (_ string, err error) {
+	_, span := tracer.Start(ctx, "jwt.GenerateRefreshToken")
+	defer func() { endSpan(span, err) }()
+	return s.jwtManager.GenerateRefreshToken(guid, ip, sessionStart)
+}
+
+// generateAccessToken calls jwt.Manager GenerateAccessToken in span
+func (s *Service) generateAccessToken(ctx context.Context, guid uuid.UUID, ip string, id int, sessionStart time.Time) (_ string, err error) {
+	_, span := tracer.Start(ctx, "jwt.GenerateAccessToken")
+	defer func() { endSpan(span, err) }()
+	return s.jwtManager.GenerateAccessToken(guid, ip, id, sessionStart)
+}
@@ -0,0 +1,218 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"restAuthPart/internal/janitor"
+	"restAuthPart/internal/models"
+	"restAuthPart/internal/service"
+	"time"
+)
+
+// IDatabase is the storage wrapped by Database
+type IDatabase interface {
+	service.IDatabase
+	janitor.IDatabase
+	RehashLegacyTokens(ctx context.Context, hash func(token string) []byte) (int, error)
+	CountActiveSessions(ctx context.Context, createdAfter time.Time) (int, error)
+	Close()
+}
+
+// Database starts span for every operation of the wrapped storage
+type Database struct {
+	db     IDatabase
+	system attribute.KeyValue
+	tracer trace.Tracer
+}
+
+// dbSystems maps db.Config.Driver values to db.system attribute of spans
+var dbSystems = map[string]attribute.KeyValue{
+	"postgres": semconv.DBSystemPostgreSQL,
+	"sqlite":   semconv.DBSystemSqlite,
+}
+
+// NewDatabase ...
+func NewDatabase(db IDatabase, driver string) *Database {
+	system, ok := dbSystems[driver]
+	if !ok {
+		system = semconv.DBSystemKey.String(driver)
+	}
+	return &Database{
+		db:     db,
+		system: system,
+		tracer: otel.Tracer("restAuthPart/internal/db"),
+	}
+}
+
+// start starts client span of storage operation
+func (d *Database) start(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return d.tracer.Start(ctx, "db."+operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(d.system, semconv.DBOperationName(operation)))
+}
+
+// end ends span recording err. models.ErrNotFound is an expected result, not a failure
+func end(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Close ...
+func (d *Database) Close() {
+	d.db.Close()
+}
+
+// Ping ...
+func (d *Database) Ping(ctx context.Context) (err error) {
+	ctx, span := d.start(ctx, "Ping")
+	defer func() { end(span, err) }()
+	return d.db.Ping(ctx)
+}
+
+// AddUserIfNotExist ...
+func (d *Database) AddUserIfNotExist(ctx context.Context, user models.User) (err error) {
+	ctx, span := d.start(ctx, "AddUserIfNotExist")
+	defer func() { end(span, err) }()
+	return d.db.AddUserIfNotExist(ctx, user)
+}
+
+// AddTokenFamily ...
+func (d *Database) AddTokenFamily(ctx context.Context, guid uuid.UUID) (_ uuid.UUID, err error) {
+	ctx, span := d.start(ctx, "AddTokenFamily")
+	defer func() { end(span, err) }()
+	return d.db.AddTokenFamily(ctx, guid)
+}
+
+// AddRefreshToken ...
+func (d *Database) AddRefreshToken(ctx context.Context, token models.RefreshToken) (_ int, err error) {
+	ctx, span := d.start(ctx, "AddRefreshToken")
+	defer func() { end(span, err) }()
+	return d.db.AddRefreshToken(ctx, token)
+}
+
+// GetRefreshToken ...
+func (d *Database) GetRefreshToken(ctx context.Context, refreshTokenId int) (_ models.RefreshToken, err error) {
+	ctx, span := d.start(ctx, "GetRefreshToken")
+	defer func() { end(span, err) }()
+	return d.db.GetRefreshToken(ctx, refreshTokenId)
+}
+
+// GetRefreshTokenByHash ...
+func (d *Database) GetRefreshTokenByHash(ctx context.Context, tokenHash []byte) (_ models.RefreshToken, err error) {
+	ctx, span := d.start(ctx, "GetRefreshTokenByHash")
+	defer func() { end(span, err) }()
+	return d.db.GetRefreshTokenByHash(ctx, tokenHash)
+}
+
+// MarkRefreshTokenUsed ...
+func (d *Database) MarkRefreshTokenUsed(ctx context.Context, refreshTokenId int, ip string) (_ bool, err error) {
+	ctx, span := d.start(ctx, "MarkRefreshTokenUsed")
+	defer func() { end(span, err) }()
+	return d.db.MarkRefreshTokenUsed(ctx, refreshTokenId, ip)
+}
+
+// RevokeTokenFamily ...
+func (d *Database) RevokeTokenFamily(ctx context.Context, familyId uuid.UUID) (err error) {
+	ctx, span := d.start(ctx, "RevokeTokenFamily")
+	defer func() { end(span, err) }()
+	return d.db.RevokeTokenFamily(ctx, familyId)
+}
+
+// RevokeRefreshToken ...
+func (d *Database) RevokeRefreshToken(ctx context.Context, refreshTokenId int) (err error) {
+	ctx, span := d.start(ctx, "RevokeRefreshToken")
+	defer func() { end(span, err) }()
+	return d.db.RevokeRefreshToken(ctx, refreshTokenId)
+}
+
+// GetUser ...
+func (d *Database) GetUser(ctx context.Context, guid uuid.UUID) (_ models.User, err error) {
+	ctx, span := d.start(ctx, "GetUser")
+	defer func() { end(span, err) }()
+	return d.db.GetUser(ctx, guid)
+}
+
+// RevokeUserTokens ...
+func (d *Database) RevokeUserTokens(ctx context.Context, guid uuid.UUID, revokedBefore time.Time) (err error) {
+	ctx, span := d.start(ctx, "RevokeUserTokens")
+	defer func() { end(span, err) }()
+	return d.db.RevokeUserTokens(ctx, guid, revokedBefore)
+}
+
+// DenyAccessToken ...
+func (d *Database) DenyAccessToken(ctx context.Context, jti string, expiresAt time.Time) (err error) {
+	ctx, span := d.start(ctx, "DenyAccessToken")
+	defer func() { end(span, err) }()
+	return d.db.DenyAccessToken(ctx, jti, expiresAt)
+}
+
+// IsAccessTokenDenied ...
+func (d *Database) IsAccessTokenDenied(ctx context.Context, jti string) (_ bool, err error) {
+	ctx, span := d.start(ctx, "IsAccessTokenDenied")
+	defer func() { end(span, err) }()
+	return d.db.IsAccessTokenDenied(ctx, jti)
+}
+
+// GetSessions ...
+func (d *Database) GetSessions(ctx context.Context, guid uuid.UUID, createdAfter time.Time) (_ []models.Session, err error) {
+	ctx, span := d.start(ctx, "GetSessions")
+	defer func() { end(span, err) }()
+	return d.db.GetSessions(ctx, guid, createdAfter)
+}
+
+// RevokeSession ...
+func (d *Database) RevokeSession(ctx context.Context, guid uuid.UUID, sessionId uuid.UUID) (_ bool, err error) {
+	ctx, span := d.start(ctx, "RevokeSession")
+	defer func() { end(span, err) }()
+	return d.db.RevokeSession(ctx, guid, sessionId)
+}
+
+// AddIPChangeEvent ...
+func (d *Database) AddIPChangeEvent(ctx context.Context, event models.IPChangeEvent) (err error) {
+	ctx, span := d.start(ctx, "AddIPChangeEvent")
+	defer func() { end(span, err) }()
+	return d.db.AddIPChangeEvent(ctx, event)
+}
+
+// CountActiveSessions ...
+func (d *Database) CountActiveSessions(ctx context.Context, createdAfter time.Time) (_ int, err error) {
+	ctx, span := d.start(ctx, "CountActiveSessions")
+	defer func() { end(span, err) }()
+	return d.db.CountActiveSessions(ctx, createdAfter)
+}
+
+// RehashLegacyTokens ...
+func (d *Database) RehashLegacyTokens(ctx context.Context, hash func(token string) []byte) (_ int, err error) {
+	ctx, span := d.start(ctx, "RehashLegacyTokens")
+	defer func() { end(span, err) }()
+	return d.db.RehashLegacyTokens(ctx, hash)
+}
+
+// DeleteStaleTokens ...
+func (d *Database) DeleteStaleTokens(ctx context.Context, expiredBefore, revokedBefore time.Time, limit int) (_ int, err error) {
+	ctx, span := d.start(ctx, "DeleteStaleTokens")
+	defer func() { end(span, err) }()
+	return d.db.DeleteStaleTokens(ctx, expiredBefore, revokedBefore, limit)
+}
+
+// DeleteStaleFamilies ...
+func (d *Database) DeleteStaleFamilies(ctx context.Context, createdBefore time.Time, limit int) (_ int, err error) {
+	ctx, span := d.start(ctx, "DeleteStaleFamilies")
+	defer func() { end(span, err) }()
+	return d.db.DeleteStaleFamilies(ctx, createdBefore, limit)
+}
+
+// DeleteExpiredDeniedTokens ...
+func (d *Database) DeleteExpiredDeniedTokens(ctx context.Context, expiredBefore time.Time, limit int) (_ int, err error) {
+	ctx, span := d.start(ctx, "DeleteExpiredDeniedTokens")
+	defer func() { end(span, err) }()
+	return d.db.DeleteExpiredDeniedTokens(ctx, expiredBefore, limit)
+}
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// Config ...
+type Config struct {
+	// Endpoint is host:port of OTLP/HTTP collector, tracing is disabled if it is empty
+	Endpoint    string  `yaml:"endpoint" env:"ENDPOINT" env-default:""`
+	Insecure    bool    `yaml:"insecure" env:"INSECURE" env-default:"false"`
+	SampleRatio float64 `yaml:"sampleRatio" env:"SAMPLE_RATIO" env-default:"1"`
+	ServiceName string  `yaml:"serviceName" env:"SERVICE_NAME" env-default:"restAuthPart"`
+}
+
+// Tracing exports spans of the server to OTLP collector
+type Tracing struct {
+	cfg      *Config
+	provider *sdktrace.TracerProvider
+}
+
+// New sets up global tracer provider exporting to cfg.Endpoint.
+// Global provider is kept noop if tracing is disabled
+func New(ctx context.Context, cfg *Config) (*Tracing, error) {
+	t := &Tracing{cfg: cfg}
+	// W3C traceparent of incoming requests is read even if own spans aren't exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !t.Enabled() {
+		return t, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(t.provider)
+	return t, nil
+}
+
+// Enabled reports whether spans are exported
+func (t *Tracing) Enabled() bool {
+	return t.cfg.Endpoint != ""
+}
+
+// Middleware starts span of request continuing trace of incoming traceparent header.
+// Span is named after the matched chi route. Returns next as is if tracing is disabled
+func (t *Tracing) Middleware(next http.Handler) http.Handler {
+	if !t.Enabled() {
+		return next
+	}
+
+	named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+		}
+	})
+	return otelhttp.NewHandler(named, "http.server",
+		otelhttp.WithTracerProvider(t.provider),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method }))
+}
+
+// Shutdown flushes buffered spans
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
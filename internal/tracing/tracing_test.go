@@ -0,0 +1,56 @@
+package tracing
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"restAuthPart/internal/db"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	// Arrange
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracing := &Tracing{cfg: &Config{Endpoint: "collector:4318"}, provider: provider}
+
+	database := NewDatabase(db.NewMemory(), "memory")
+	r := chi.NewRouter()
+	r.Use(tracing.Middleware)
+	r.Get("/users/{guid}", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = database.GetUser(r.Context(), uuid.New())
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/users/"+uuid.NewString(), nil)
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+
+	// Act
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	_ = provider.ForceFlush(context.Background())
+
+	// Assert
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("wrong number of spans: got %v want 2", len(spans))
+	}
+	query, request := spans[0], spans[1]
+	if request.Name != "GET /users/{guid}" || query.Name != "db.GetUser" {
+		t.Errorf("wrong span names: got %v, %v want GET /users/{guid}, db.GetUser", request.Name, query.Name)
+	}
+	if request.SpanContext.TraceID().String() != traceId {
+		t.Errorf("incoming trace isn't continued: got %v want %v", request.SpanContext.TraceID(), traceId)
+	}
+	if query.Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Errorf("query span isn't a child of request span")
+	}
+}